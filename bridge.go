@@ -6,95 +6,246 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"math"
 	"net/http"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
-	"unsafe"
-
-	"github.com/wasmerio/go-ext-wasm/wasmer"
 )
 
 var (
 	undefined = &struct{}{}
-	bridges   = map[string]*Bridge{}
-	mu        sync.RWMutex // to protect bridges
-)
-
-type bctx struct{ n string }
-
-func getCtxData(b *Bridge) (*bctx, error) {
-	mu.Lock()
-	defer mu.Unlock()
-	if _, ok := bridges[b.name]; ok {
-		return nil, fmt.Errorf("bridge with name %s already exists", b.name)
-	}
 
-	bridges[b.name] = b
-	return &bctx{n: b.name}, nil
-}
+	// bridgeCount is used to name the bridges created without one.
+	bridgeCount uint64
 
-func getBridge(ctx unsafe.Pointer) *Bridge {
-	ictx := wasmer.IntoInstanceContext(ctx)
-	c := (ictx.Data()).(*bctx)
-	mu.RLock()
-	defer mu.RUnlock()
-	return bridges[c.n]
-}
+	// instanceCount numbers the bridges, see Bridge.Instance.
+	instanceCount uint64
+)
 
 type Bridge struct {
 	name     string
-	instance wasmer.Instance
+	id       uint64 // tells apart the bridges of the same name, see Instance
+	instance Instance
 	exitCode int
+	errTail  []byte     // tail of the guest's stderr, for its crash reports
+	trap     *GuestTrap // crash report of the guest's runtime, if it panicked
+	crash    error      // see Err
 	valueIDX int
 	valueMap map[int]interface{}
 	refs     map[interface{}]int
 	valuesMu sync.RWMutex
-	memory   []byte
-	exited   bool
-	cancF    context.CancelFunc
+
+	// modern guests count the references they hold to each value, and the
+	// ids of the values they all dropped are reused, see finalizeRef
+	modern    bool
+	refCounts map[int]int
+	idPool    []int
+
+	memory  []byte
+	exited  bool
+	started bool // the guest was run, see RestoreBridge
+
+	engine    Engine
+	goVersion string
+	symbols   *symbols
+	config    InstanceConfig
+	timeLimit time.Duration // caps each run of the guest, see WithTimeLimit
+
+	logger  *slog.Logger
+	rec     *recorder
+	replay  *replayer
+	tracer  Tracer
+	metrics Metrics
+	profMu  sync.Mutex
+	prof    *profile
+
+	// metricsKey is the name and id of the bridge, the key of its metrics.
+	metricsKey string
+
+	// results describe the values stored by the imports being recorded or
+	// traced, innermost last, see storeValue. Host functions get one of their
+	// own for the values stored when they call back into the guest.
+	results []string
+
+	// execMu is held while the guest runs on behalf of a CallFunc, Run or a
+	// timer. It is given up while the guest calls a host function, which may
+	// call back into the guest, see hostCall. depth counts the calls into the
+	// guest in progress, nested ones included, and is guarded by execMu.
+	execMu   sync.Mutex
+	depth    int
+	released bool
+	running  int32 // calls into the guest in progress, for the profiler
+
+	// aborted is the error a host function aborted the guest with, see abort.
+	aborted error
+
+	// gettingSP is set while the host calls getsp, which isn't the guest's work.
+	gettingSP bool
+
+	stateMu sync.Mutex // protects closed, exited, exitCode, crash and cancF
+	closed  bool
+	cancF   context.CancelFunc
+	done    chan struct{}
+
+	timersMu sync.Mutex
+	timerID  int32
+	timers   map[int32]timer
+	timeouts chan timeout
+	clock    Clock
+	random   io.Reader
+
+	// the guest's process and files, see WithArgs and friends
+	args           []string
+	env            []string
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	files          fileSystem
+	exitOnDeadlock bool
+
+	// gen is bumped every time the guest is resumed or a host function returns
+	// to it. Borrowed Views are tied to it.
+	gen     uint64
+	checked bool
 }
 
-func BridgeFromBytes(name string, bytes []byte, imports *wasmer.Imports) (*Bridge, error) {
-	b := new(Bridge)
-	if imports == nil {
-		imports = wasmer.NewImports()
+var (
+	// ErrBridgeClosed is returned when using a bridge that was closed or whose guest exited.
+	ErrBridgeClosed = errors.New("wasm: bridge is closed")
+
+	// ErrOutOfMemory is wrapped by the error returned when the guest tried to
+	// grow its memory beyond WithMaxMemory. The guest can't recover from it.
+	ErrOutOfMemory = errors.New("wasm: guest is out of memory")
+
+	// ErrInterrupted is wrapped by the error returned when the guest was
+	// interrupted, by Interrupt, WithTimeLimit or by cancelling Run's context.
+	ErrInterrupted = errors.New("wasm: guest was interrupted")
+)
+
+// Option configures a Bridge.
+type Option func(b *Bridge)
+
+// WithCheckedViews makes Views returned by Borrow fail with ErrViewExpired
+// once the guest has been resumed, instead of handing out possibly stale memory,
+// and buffers lent with Lend fail with ErrBufferReleased once released.
+func WithCheckedViews() Option {
+	return func(b *Bridge) {
+		b.checked = true
 	}
+}
 
-	b.name = name
-	err := b.addImports(imports)
+// WithMaxMemory caps the guest's linear memory at bytes. The guest fails to
+// grow its memory past it, which Go guests treat as fatal, and CallFunc or Run
+// return an error wrapping ErrOutOfMemory. wasmer can't enforce the limit, use
+// WithEngine(WazeroEngine()) with it.
+func WithMaxMemory(bytes int) Option {
+	return func(b *Bridge) {
+		b.config.MaxMemory = bytes
+	}
+}
+
+// WithTimeLimit interrupts the guest when it runs for longer than d in one go:
+// starting up in Run, serving a CallFunc or handling a timer. Time spent in
+// host functions counts as well. The interrupted call returns an error
+// wrapping ErrInterrupted, and the bridge can't be used afterwards. wasmer
+// can't interrupt guests, use WithEngine(WazeroEngine()) with it.
+func WithTimeLimit(d time.Duration) Option {
+	return func(b *Bridge) {
+		b.timeLimit = d
+		b.config.Interruptible = d > 0
+	}
+}
+
+// BridgeFromBytes instantiates the wasm bytes. name identifies the bridge in
+// diagnostics, a unique one is generated if it is empty.
+// Use a Module to instantiate the same bytes more than once.
+func BridgeFromBytes(name string, bytes []byte, opts ...Option) (*Bridge, error) {
+	b := configure(opts)
+	e := b.engine
+	if e == nil {
+		e = DefaultEngine()
+	}
+
+	m, err := e.Compile(bytes)
 	if err != nil {
 		return nil, err
 	}
 
-	inst, err := wasmer.NewInstanceWithImports(bytes, imports)
-	if err != nil {
+	defer m.Close()
+	if err := b.instantiate(name, newModule(m, bytes)); err != nil {
 		return nil, err
 	}
 
-	ctx, err := getCtxData(b)
-	if err != nil {
+	return b, nil
+}
+
+func newBridge(name string, m *Module, opts []Option) (*Bridge, error) {
+	b := configure(opts)
+	if err := b.instantiate(name, m); err != nil {
 		return nil, err
 	}
 
+	return b, nil
+}
+
+// configure returns a bridge with the defaults and opts applied, each once.
+func configure(opts []Option) *Bridge {
+	b := new(Bridge)
+	b.clock = realClock{}
+	b.random = rand.Reader
+	b.logger = slog.New(discardHandler{})
+	b.stdout, b.stderr = os.Stdout, os.Stderr
+	b.files.cwd = "/"
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b
+}
+
+// instantiate instantiates m for the configured bridge.
+func (b *Bridge) instantiate(name string, m *Module) error {
+	if name == "" {
+		name = fmt.Sprintf("bridge-%d", atomic.AddUint64(&bridgeCount, 1))
+	}
+
+	b.name = name
+	b.goVersion = m.goVersion
+	b.modern = m.modern
+	b.symbols = m.symbols
+	b.id = atomic.AddUint64(&instanceCount, 1)
+	b.metricsKey = name + "#" + strconv.FormatUint(b.id, 10)
+	b.logger = b.logger.With("bridge", name, "instance", b.id)
+
+	inst, err := m.module.Instantiate(b.imports(), b.config)
+	if err != nil {
+		return err
+	}
+
 	b.instance = inst
-	inst.SetContextData(ctx)
+	b.done = make(chan struct{})
+	b.timers = make(map[int32]timer)
+	b.timeouts = make(chan timeout)
 	b.addValues()
 	b.refs = make(map[interface{}]int)
+	b.refCounts = make(map[int]int)
 	b.valueIDX = 8
-	return b, nil
+	return nil
 }
 
-func BridgeFromFile(name, file string, imports *wasmer.Imports) (*Bridge, error) {
-	bytes, err := wasmer.ReadBytes(file)
+func BridgeFromFile(name, file string, opts ...Option) (*Bridge, error) {
+	bytes, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
 
-	return BridgeFromBytes(name, bytes, imports)
+	return BridgeFromBytes(name, bytes, opts...)
 }
 
 func (b *Bridge) addValues() {
@@ -116,11 +267,28 @@ func (b *Bridge) addValues() {
 				"Object": &object{name: "Object", new: func(args []interface{}) interface{} {
 					return &object{name: "ObjectInner", props: map[string]interface{}{}}
 				}},
-				"Array":      arrayObject("Array"),
-				"Uint8Array": arrayObject("Uint8Array"),
-				"process":    propObject("process", nil),
+				"Array": &object{name: "Array", new: func(args []interface{}) interface{} {
+					var l int
+					if len(args) > 0 {
+						l = int(toFloat(args[0]))
+					}
+					arr := make([]interface{}, l, l)
+					return &arr
+				}},
+				"ArrayBuffer":       arrayBufferObject(),
+				"DataView":          dataViewObject(),
+				"Int8Array":         typedArrayObject(kindInt8),
+				"Uint8Array":        typedArrayObject(kindUint8),
+				"Uint8ClampedArray": typedArrayObject(kindUint8Clamped),
+				"Int16Array":        typedArrayObject(kindInt16),
+				"Uint16Array":       typedArrayObject(kindUint16),
+				"Int32Array":        typedArrayObject(kindInt32),
+				"Uint32Array":       typedArrayObject(kindUint32),
+				"Float32Array":      typedArrayObject(kindFloat32),
+				"Float64Array":      typedArrayObject(kindFloat64),
+				"process":           b.processObject(),
 				"Date": &object{name: "Date", new: func(args []interface{}) interface{} {
-					t := time.Now()
+					t := b.clock.Now()
 					return &object{name: "DateInner", props: map[string]interface{}{
 						"time": t,
 						"getTimezoneOffset": Func(func(args []interface{}) (interface{}, error) {
@@ -134,8 +302,13 @@ func (b *Bridge) addValues() {
 				}},
 				"crypto": propObject("crypto", map[string]interface{}{
 					"getRandomValues": Func(func(args []interface{}) (interface{}, error) {
-						arr := args[0].(*array)
-						return rand.Read(arr.buf)
+						buf, ok := byteView(args[0])
+						if !ok {
+							return nil, fmt.Errorf("getRandomValues: expected typed array, got %T", args[0])
+						}
+
+						_, err := io.ReadFull(b.random, buf)
+						return args[0], err
 					}),
 				}),
 				"AbortController": &object{name: "AbortController", new: func(args []interface{}) interface{} {
@@ -157,108 +330,278 @@ func (b *Bridge) addValues() {
 				}},
 				"fetch": Func(func(args []interface{}) (interface{}, error) {
 					// Fixme(ved): implement fetch
-					log.Fatalln(args)
-					return nil, nil
-				}),
-				"fs": propObject("fs", map[string]interface{}{
-					"constants": propObject("constants", map[string]interface{}{
-						"O_WRONLY": syscall.O_WRONLY,
-						"O_RDWR":   syscall.O_RDWR,
-						"O_CREAT":  syscall.O_CREAT,
-						"O_TRUNC":  syscall.O_TRUNC,
-						"O_APPEND": syscall.O_APPEND,
-						"O_EXCL":   syscall.O_EXCL,
-					}),
-
-					"write": Func(func(args []interface{}) (interface{}, error) {
-						fd := int(args[0].(float64))
-						offset := int(args[2].(float64))
-						length := int(args[3].(float64))
-						buf := args[1].(*array).buf[offset : offset+length]
-						pos := args[4]
-						callback := args[5].(*funcWrapper)
-						var err error
-						var n int
-						if pos != nil {
-							position := int64(pos.(float64))
-							n, err = syscall.Pwrite(fd, buf, position)
-						} else {
-							n, err = syscall.Write(fd, buf)
-						}
-
-						if err != nil {
-							return nil, err
-						}
-
-						return b.makeFuncWrapper(callback.id, goObj, &[]interface{}{nil, n})
-					}),
+					b.logger.Error("fetch is not implemented", "args", describeList(args))
+					return nil, errors.New("fetch is not implemented")
 				}),
+				"fs":   b.fsObject(goObj),
+				"path": b.pathObject(),
 			},
 		}, // global
 		6: goObj, // jsGo
 	}
+	holdFuncs(b.valueMap[5].(*object))
+	holdFuncs(goObj)
 }
 
-func (b *Bridge) check() {
-	if b.exited {
-		panic("WASM instance already exited")
+// holdFuncs makes the host functions in the props of obj, and of the objects
+// in them, pointers, which identify them, see Snapshot.
+func holdFuncs(obj *object) {
+	for name, v := range obj.props {
+		switch v := v.(type) {
+		case Func:
+			obj.props[name] = &v
+		case Method:
+			obj.props[name] = &v
+		case *object:
+			holdFuncs(v)
+		}
 	}
 }
 
-// Run start the wasm instance.
-func (b *Bridge) Run(ctx context.Context, init chan error) {
-	b.check()
-	defer b.instance.Close()
+func (b *Bridge) check() error {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+	if b.closed || b.exited {
+		return ErrBridgeClosed
+	}
+
+	return nil
+}
 
-	run := b.instance.Exports["run"]
-	_, err := run(0, 0)
+// enter waits for the guest to be idle, or waiting in a host function, and
+// returns with it owned by the caller. leave must be called once the caller is
+// done with the guest.
+func (b *Bridge) enter() (leave func(), err error) {
+	b.execMu.Lock()
+	if err := b.check(); err != nil {
+		b.execMu.Unlock()
+		return nil, err
+	}
+
+	b.depth++
+	stop := b.watch()
+	return func() {
+		stop()
+
+		// Close was called while the guest was in a host function, it is
+		// freed once the outermost call returns
+		b.depth--
+		if b.depth == 0 && b.check() != nil {
+			b.release()
+		}
+		b.execMu.Unlock()
+	}, nil
+}
+
+// watch interrupts the guest unless stop is called within the time limit.
+func (b *Bridge) watch() (stop func()) {
+	if b.timeLimit <= 0 {
+		return func() {}
+	}
+
+	t := time.AfterFunc(b.timeLimit, b.instance.Interrupt)
+	return func() {
+		t.Stop()
+	}
+}
+
+// Interrupt aborts the guest if it is running, or else the next time it runs.
+// The call running it returns an error wrapping ErrInterrupted, and the bridge
+// can't be used afterwards. It may be called from any goroutine. wasmer can't
+// interrupt guests and ignores it.
+func (b *Bridge) Interrupt() {
+	b.instance.Interrupt()
+}
+
+// hostCall runs fn, a call into host code on behalf of the guest. The guest
+// waits for fn where JS code may call it again, so execMu is given up for fn
+// to call back into the guest, and other callers to take their turn.
+func (b *Bridge) hostCall(fn func()) {
+	if b.rec != nil || b.tracer != nil {
+		b.results = append(b.results, "")
+		defer func() { b.results = b.results[:len(b.results)-1] }()
+	}
+
+	b.execMu.Unlock()
+	defer func() {
+		b.execMu.Lock()
+
+		// what fn borrowed expires as the guest goes on
+		b.gen++
+	}()
+
+	fn()
+}
+
+// Run start the wasm instance. It returns once ctx is done or the guest exits
+// and closes the bridge. Cancelling ctx also interrupts the guest if it is
+// running, as Interrupt does.
+//
+// CallFunc can be used from any goroutine once init has received nil, calls
+// are serialised with each other and with the guest's timers.
+func (b *Bridge) Run(ctx context.Context, init chan error) {
+	leave, err := b.enter()
 	if err != nil {
 		init <- err
 		return
 	}
 
+	stop := context.AfterFunc(ctx, b.Interrupt)
+	defer stop()
+
 	ctx, cancF := context.WithCancel(ctx)
+	b.stateMu.Lock()
 	b.cancF = cancF
+	b.stateMu.Unlock()
+	defer b.Close()
+
+	// the guest is left before Close, also when a host function panicked
+	var once sync.Once
+	defer once.Do(leave)
+
+	b.gen++
+	if !b.started {
+		var argc, argv int32
+		argc, argv, err = b.writeArgs()
+		if err == nil {
+			b.started = true
+			err = b.crashed(b.callGuest("run", argc, argv))
+		}
+	}
+	b.memory = nil
+	if err == nil && b.metrics != nil {
+		b.reportSizes()
+	}
+	once.Do(leave)
+	if err != nil {
+		init <- err
+		return
+	}
+
 	init <- nil
-	select {
-	case <-ctx.Done():
-		log.Printf("stopping WASM[%s] instance...\n", b.name)
-		b.exited = true
+	b.wakeDeadlocked()
+	for {
+		select {
+		case <-ctx.Done():
+			b.logger.Info("stopping instance")
+			return
+		case t := <-b.timeouts:
+			b.fireTimeout(t.id)
+			close(t.handled)
+			b.wakeDeadlocked()
+		}
+	}
+}
+
+// Close stops Run, cancels the guest's timers and frees the instance and the
+// values held for the guest. Using the bridge afterwards returns ErrBridgeClosed.
+// Close is idempotent. A guest still running is interrupted, and when the guest
+// is in a host function, e.g. the one calling Close, the instance is freed once
+// it returns from it. Close returns the error, if any, of writing the trace of
+// WithRecorder.
+func (b *Bridge) Close() error {
+	b.stateMu.Lock()
+	if b.closed {
+		b.stateMu.Unlock()
+		return nil
+	}
+
+	b.closed = true
+	if b.cancF != nil {
+		b.cancF()
+	}
+	close(b.done)
+	b.stateMu.Unlock()
+
+	b.stopTimers()
+
+	// a guest that runs away would keep execMu forever
+	b.Interrupt()
+	b.execMu.Lock()
+	defer b.execMu.Unlock()
+	if b.depth > 0 {
+		// the guest is in a host function, enter's leave frees it
+		return nil
+	}
+
+	b.release()
+	if b.rec != nil {
+		return b.rec.err
+	}
+
+	return nil
+}
+
+// release frees the instance and the values. Must be called with execMu held.
+func (b *Bridge) release() {
+	if b.released {
 		return
 	}
+
+	b.released = true
+	if b.rec != nil {
+		b.rec.flush()
+	}
+
+	b.instance.Close()
+	b.memory = nil
+	b.files.closeAll()
+	b.valuesMu.Lock()
+	b.valueMap = nil
+	b.refs = nil
+	b.refCounts = nil
+	b.valuesMu.Unlock()
+	if b.metrics != nil {
+		b.metrics.Remove(b.metricsKey)
+	}
+}
+
+// Name returns the name of the bridge.
+func (b *Bridge) Name() string {
+	return b.name
+}
+
+// Instance returns the number of the bridge, unique in the process. Bridges
+// may share a name, as those of a Pool do.
+func (b *Bridge) Instance() uint64 {
+	return b.id
 }
 
 func (b *Bridge) mem() []byte {
 	if b.memory == nil {
-		b.memory = b.instance.Memory.Data()
+		b.memory = b.instance.Memory()
 	}
 
 	return b.memory
 }
 
 func (b *Bridge) getSP() int32 {
-	spFunc := b.instance.Exports["getsp"]
-	val, err := spFunc()
+	b.gettingSP = true
+	sp, err := b.instance.Call("getsp")
+	b.gettingSP = false
 	if err != nil {
-		panic("failed to get sp")
+		panic(fmt.Sprint("failed to get sp: ", err))
 	}
 
-	return val.ToI32()
+	return sp
 }
 
 func (b *Bridge) setUint8(offset int32, v uint8) {
 	mem := b.mem()
 	mem[offset] = byte(v)
+	b.wrote(offset, 1)
 }
 
 func (b *Bridge) setInt64(offset int32, v int64) {
 	mem := b.mem()
 	binary.LittleEndian.PutUint64(mem[offset:], uint64(v))
+	b.wrote(offset, 8)
 }
 
 func (b *Bridge) setInt32(offset int32, v int32) {
 	mem := b.mem()
 	binary.LittleEndian.PutUint32(mem[offset:], uint32(v))
+	b.wrote(offset, 4)
 }
 
 func (b *Bridge) getInt64(offset int32) int64 {
@@ -274,11 +617,13 @@ func (b *Bridge) getInt32(offset int32) int32 {
 func (b *Bridge) setUint32(offset int32, v uint32) {
 	mem := b.mem()
 	binary.LittleEndian.PutUint32(mem[offset:], v)
+	b.wrote(offset, 4)
 }
 
 func (b *Bridge) setUint64(offset int32, v uint64) {
 	mem := b.mem()
 	binary.LittleEndian.PutUint64(mem[offset:], v)
+	b.wrote(offset, 8)
 }
 
 func (b *Bridge) getUnit64(offset int32) uint64 {
@@ -342,6 +687,10 @@ func (b *Bridge) loadValue(addr int32) interface{} {
 func (b *Bridge) storeValue(addr int32, v interface{}) {
 	const nanHead = 0x7FF80000
 
+	if n := len(b.results); n > 0 {
+		b.results[n-1] = describe(v)
+	}
+
 	if i, ok := v.(int); ok {
 		v = float64(i)
 	}
@@ -385,26 +734,36 @@ func (b *Bridge) storeValue(addr int32, v interface{}) {
 		return
 	}
 
-	rt := reflect.TypeOf(v)
-	if rt.Kind() == reflect.Ptr {
-		rt = rt.Elem()
-	}
-
-	rv := v
-	if !rt.Comparable() {
-		// since some types like Func cant be set as key, we will use their reflect value
-		// as key to insert for refs[key] so that we can avoid any duplicates
-		rv = reflect.ValueOf(v)
+	// host functions are held by pointer, which identifies them, see Snapshot
+	switch fn := v.(type) {
+	case Func:
+		v = &fn
+	case Method:
+		v = &fn
 	}
 
+	rv := refKey(v)
+	b.valuesMu.Lock()
 	ref, ok := b.refs[rv]
 	if !ok {
-		b.valuesMu.RLock()
-		b.valueMap[b.valueIDX] = v
 		ref = b.valueIDX
+		if n := len(b.idPool); n > 0 {
+			ref = b.idPool[n-1]
+			b.idPool = b.idPool[:n-1]
+		} else {
+			b.valueIDX++
+		}
+		b.valueMap[ref] = v
 		b.refs[rv] = ref
-		b.valueIDX++
-		b.valuesMu.RUnlock()
+	}
+	if b.modern {
+		b.refCounts[ref]++
+	}
+	b.valuesMu.Unlock()
+
+	rt := reflect.TypeOf(v)
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
 	}
 
 	typeFlag := 0
@@ -414,45 +773,126 @@ func (b *Bridge) storeValue(addr int32, v interface{}) {
 	case reflect.Func:
 		typeFlag = 3
 	}
+	if o, ok := v.(*object); ok && o.new != nil {
+		// constructors are functions
+		typeFlag = 3
+	}
+
+	// modern guests also flag objects, and tell them from null by it
+	if b.modern {
+		typeFlag++
+	}
 	b.setUint32(addr+4, uint32(nanHead|typeFlag))
 	b.setUint32(addr, uint32(ref))
 }
 
+// refKey returns the key of v in refs.
+func refKey(v interface{}) interface{} {
+	rt := reflect.TypeOf(v)
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+
+	if !rt.Comparable() {
+		// since some types like Func cant be set as key, we will use their reflect value
+		// as key to insert for refs[key] so that we can avoid any duplicates
+		return reflect.ValueOf(v)
+	}
+
+	return v
+}
+
 type object struct {
 	name  string // for debugging
 	props map[string]interface{}
 	new   func(args []interface{}) interface{}
 }
 
+func (o *object) get(prop string) (interface{}, bool) {
+	v, ok := o.props[prop]
+	return v, ok
+}
+
 func propObject(name string, prop map[string]interface{}) *object {
 	return &object{name: name, props: prop}
 }
 
-type array struct {
-	buf []byte
+// propGetter is implemented by the host values that expose properties to the guest.
+type propGetter interface {
+	get(prop string) (interface{}, bool)
 }
 
-func arrayObject(name string) *object {
-	return &object{
-		name: name,
-		new: func(args []interface{}) interface{} {
-			l := int(args[0].(float64))
-			return &array{
-				buf: make([]byte, l, l),
-			}
-		},
+// Func is a host function the guest can call.
+type Func func(args []interface{}) (interface{}, error)
+
+// Method is a host function that also receives the object it was called on,
+// `obj` for `obj.Call("method")` in the guest, and undefined for `fn.Invoke()`.
+// This lets one Method back the same method of many objects.
+type Method func(this interface{}, args []interface{}) (interface{}, error)
+
+// asMethod returns the host function held by v as a Method. The global object
+// holds them as *Func or *Method and host objects hand out Funcs.
+func asMethod(v interface{}) (Method, bool) {
+	switch f := v.(type) {
+	case *Func:
+		if f == nil {
+			return nil, false
+		}
+		return asMethod(*f)
+	case *Method:
+		if f == nil {
+			return nil, false
+		}
+		return asMethod(*f)
+	case Func:
+		return func(_ interface{}, args []interface{}) (interface{}, error) {
+			return f(args)
+		}, f != nil
+	case Method:
+		return f, f != nil
 	}
+
+	return nil, false
 }
 
-// TODO make this a wrapper that takes an inner `this` js object
-type Func func(args []interface{}) (interface{}, error)
+// callGuest calls the guest's export name, recording it when asked to.
+func (b *Bridge) callGuest(name string, args ...int32) error {
+	atomic.AddInt32(&b.running, 1)
+	defer atomic.AddInt32(&b.running, -1)
+	var err error
+	if b.rec != nil {
+		err = b.rec.enter(b, name, args...)
+	} else {
+		_, err = b.instance.Call(name, args...)
+	}
+
+	if err != nil && b.aborted != nil {
+		err = b.aborted
+	}
+
+	return err
+}
 
 func (b *Bridge) resume() error {
-	res := b.instance.Exports["resume"]
-	_, err := res()
+	b.gen++
+	start := time.Now()
+	err := b.crashed(b.callGuest("resume"))
+	b.memory = nil
+	if b.metrics != nil {
+		b.resumed(start, err)
+	}
 	return err
 }
 
+// MemorySize returns the size of the guest's linear memory in bytes.
+func (b *Bridge) MemorySize() int {
+	if b.check() != nil {
+		return 0
+	}
+
+	return len(b.instance.Memory())
+}
+
 type funcWrapper struct {
 	id interface{}
 }
@@ -474,32 +914,204 @@ func (b *Bridge) makeFuncWrapper(id, this interface{}, args *[]interface{}) (int
 	return event.props["result"], nil
 }
 
+// CallFunc calls the guest function fn with args. fn is a path to the function
+// from the global object, e.g. "addition" or "myapp.handlers.add".
 func (b *Bridge) CallFunc(fn string, args []interface{}) (interface{}, error) {
-	b.check()
-	b.valuesMu.RLock()
-	fw, ok := b.valueMap[5].(*object).props[fn]
+	leave, err := b.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	if b.metrics != nil {
+		start := time.Now()
+		defer func() { b.metrics.Observe(b.metricsKey, MetricCallFuncSeconds, time.Since(start).Seconds()) }()
+	}
+
+	names, err := splitPath(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := b.getValue(names)
+	if err != nil {
+		return nil, err
+	}
+
+	fw, ok := v.(*funcWrapper)
 	if !ok {
 		return nil, fmt.Errorf("missing function: %v", fn)
 	}
+
+	b.valuesMu.RLock()
 	this := b.valueMap[6]
 	b.valuesMu.RUnlock()
-	return b.makeFuncWrapper(fw.(*funcWrapper).id, this, &args)
+	if b.rec != nil {
+		b.rec.label = event{Name: fn, Args: describeList(args)}
+	}
+
+	return b.makeFuncWrapper(fw.id, this, &args)
 }
 
+// SetFunc sets fn on the global object. fname may be a path as accepted by SetValue.
 func (b *Bridge) SetFunc(fname string, fn Func) error {
+	return b.SetValue(fname, fn)
+}
+
+// SetMethod is like SetFunc, but fn receives the object it was called on.
+func (b *Bridge) SetMethod(fname string, fn Method) error {
+	return b.SetValue(fname, fn)
+}
+
+// SetValue sets v at path from the global object. The path is split on dots and
+// missing objects along it are created, so SetValue("myapp.kv.put", fn) makes
+// `myapp.kv.put` callable by the guest. SetValue waits for the guest to be
+// idle, unless called by a host function. Go values that have no JS counterpart
+// are exposed like the instances of a class registered with SetClass.
+func (b *Bridge) SetValue(path string, v interface{}) error {
+	names, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+
+	leave, err := b.enter()
+	if err != nil {
+		return err
+	}
+	defer leave()
+
+	b.valuesMu.Lock()
+	defer b.valuesMu.Unlock()
+	obj := b.valueMap[5].(*object)
+	for i, name := range names[:len(names)-1] {
+		next, ok := obj.props[name]
+		if !ok {
+			next = propObject(name, map[string]interface{}{})
+			obj.props[name] = next
+		}
+
+		obj, ok = next.(*object)
+		if !ok || obj.props == nil {
+			return fmt.Errorf("%s is not an object", strings.Join(names[:i+1], "."))
+		}
+	}
+
+	obj.props[names[len(names)-1]] = hostValue(v)
+	return nil
+}
+
+// hostValue converts a value set by the host to the value held by the bridge.
+func hostValue(v interface{}) interface{} {
+	switch fn := v.(type) {
+	case Func:
+		return &fn
+	case Method:
+		return &fn
+	}
+
+	return toJS(reflect.ValueOf(v))
+}
+
+// GetValue returns the value at path from the global object, including the
+// values set by the guest. The path is split on dots. Like SetValue, it waits
+// for the guest to be idle.
+func (b *Bridge) GetValue(path string) (interface{}, error) {
+	names, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	leave, err := b.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	return b.getValue(names)
+}
+
+// getValue returns the value at the path of names. The caller owns the guest.
+func (b *Bridge) getValue(names []string) (interface{}, error) {
 	b.valuesMu.RLock()
 	defer b.valuesMu.RUnlock()
-	b.valueMap[5].(*object).props[fname] = &fn
-	return nil
+	var v interface{} = b.valueMap[5]
+	for i, name := range names {
+		obj, ok := v.(propGetter)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an object", strings.Join(names[:i], "."))
+		}
+
+		v, ok = obj.get(name)
+		if !ok {
+			return nil, fmt.Errorf("missing property: %s", strings.Join(names[:i+1], "."))
+		}
+	}
+
+	return v, nil
+}
+
+// splitPath splits a path of SetValue or GetValue into the names along it.
+func splitPath(path string) ([]string, error) {
+	names := strings.Split(path, ".")
+	for _, name := range names {
+		if name == "" {
+			return nil, fmt.Errorf("invalid path %q: empty name", path)
+		}
+	}
+
+	return names, nil
 }
 
+// NewObject returns a JS object with props. Values are converted as by SetValue.
+// Methods among the props receive the object as this when the guest calls them.
+func NewObject(props map[string]interface{}) interface{} {
+	obj := propObject("Object", make(map[string]interface{}, len(props)))
+	for k, v := range props {
+		obj.props[k] = hostValue(v)
+	}
+
+	return obj
+}
+
+// Property returns the property prop of the object v, usually the this of a Method.
+func Property(v interface{}, prop string) (interface{}, error) {
+	obj, ok := v.(propGetter)
+	if !ok {
+		return nil, fmt.Errorf("got %T instead of object", v)
+	}
+
+	res, ok := obj.get(prop)
+	if !ok {
+		return nil, fmt.Errorf("missing property: %s", prop)
+	}
+
+	return res, nil
+}
+
+// Bytes returns the bytes viewed by a typed array, DataView or ArrayBuffer.
 func Bytes(v interface{}) ([]byte, error) {
-	arr, ok := v.(*array)
+	if ab := bufferOf(v); ab != nil && ab.detached {
+		if err := ab.released(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("buffer is detached")
+	}
+
+	buf, ok := byteView(v)
 	if !ok {
 		return nil, fmt.Errorf("got %T instead of bytes", v)
 	}
 
-	return arr.buf, nil
+	return buf, nil
+}
+
+// Float64s returns the elements of a typed array as float64s.
+func Float64s(v interface{}) ([]float64, error) {
+	if _, ok := v.(*array); !ok {
+		return nil, fmt.Errorf("got %T instead of typed array", v)
+	}
+
+	return arrayValues(v)
 }
 
 func String(v interface{}) (string, error) {
@@ -520,8 +1132,20 @@ func Error(v interface{}) (errVal, err error) {
 	return errors.New(str), nil
 }
 
+// FromBytes returns a Uint8Array holding a copy of v.
+// Use Bridge.Lend to hand a buffer to the guest without copying.
 func FromBytes(v []byte) interface{} {
 	buf := make([]byte, len(v), len(v))
 	copy(buf, v)
-	return &array{buf: buf}
+	return newArray(kindUint8, &arrayBuffer{data: buf}, 0, len(buf))
+}
+
+// FromFloat64s returns a Float64Array holding a copy of v.
+func FromFloat64s(v []float64) interface{} {
+	arr := newArray(kindFloat64, &arrayBuffer{data: make([]byte, len(v)*8)}, 0, len(v))
+	for i, f := range v {
+		arr.setIndex(i, f)
+	}
+
+	return arr
 }
@@ -0,0 +1,293 @@
+package wasm_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestSetGetValue(t *testing.T) {
+	b := startGuest(t, func(b *wasm.Bridge) {
+		err := b.SetValue("myapp.math.double", wasm.Func(func(args []interface{}) (interface{}, error) {
+			return args[0].(float64) * 2, nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	res, err := b.CallFunc("double", []interface{}{21})
+	if err != nil || res != float64(42) {
+		t.Errorf("double(21) = %v, %v, want 42", res, err)
+	}
+
+	// set up by the guest's main
+	for path, want := range map[string]interface{}{"guest.name": "guest", "guest.version": float64(2)} {
+		if v, err := b.GetValue(path); err != nil || v != want {
+			t.Errorf("GetValue(%s) = %v, %v, want %v", path, v, err, want)
+		}
+	}
+
+	if _, err := b.GetValue("guest.missing.deeper"); err == nil {
+		t.Error("GetValue of a missing path succeeded")
+	}
+
+	for _, path := range []string{"", "guest..name", ".guest", "guest."} {
+		if _, err := b.GetValue(path); err == nil {
+			t.Errorf("GetValue(%q) succeeded", path)
+		}
+		if err := b.SetValue(path, 1); err == nil {
+			t.Errorf("SetValue(%q) succeeded", path)
+		}
+	}
+}
+
+func TestSetValueWhileRunning(t *testing.T) {
+	b := startGuest(t, nil, wasm.WithTimeLimit(time.Second))
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.CallFunc("spin", nil)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// it waits for the guest, which is interrupted
+	if err := b.SetValue("late", 1); !errors.Is(err, wasm.ErrBridgeClosed) {
+		t.Errorf("SetValue while the guest spins: got %v, want %v", err, wasm.ErrBridgeClosed)
+	}
+	if err := <-done; !errors.Is(err, wasm.ErrInterrupted) {
+		t.Errorf("spin() = %v, want %v", err, wasm.ErrInterrupted)
+	}
+}
+
+func TestMethod(t *testing.T) {
+	greet := wasm.Method(func(this interface{}, args []interface{}) (interface{}, error) {
+		name, err := wasm.Property(this, "name")
+		if err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("%v, %v", args[0], name), nil
+	})
+	b := startGuest(t, func(b *wasm.Bridge) {
+		for _, name := range []string{"alice", "bob"} {
+			obj := wasm.NewObject(map[string]interface{}{"name": name, "greet": greet})
+			if err := b.SetValue(name, obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.SetMethod("carol.greet", greet); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetValue("carol.name", "carol"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// one Method backs the method of each object, which it receives
+	for _, name := range []string{"alice", "bob", "carol"} {
+		res, err := b.CallFunc("callOn", []interface{}{name, "greet", "hi"})
+		if want := "hi, " + name; err != nil || res != want {
+			t.Errorf("%s.greet(hi) = %v, %v, want %s", name, res, err, want)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	forEngines(t, func(t *testing.T, e wasm.Engine) {
+		// never run
+		b := newFunction(t, e)
+		for i := 0; i < 2; i++ {
+			if err := b.Close(); err != nil {
+				t.Fatalf("Close #%d: %v", i+1, err)
+			}
+		}
+
+		b = startFunction(t, e)
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := b.CallFunc("multiplier", nil); !errors.Is(err, wasm.ErrBridgeClosed) {
+			t.Errorf("CallFunc after Close: got %v, want %v", err, wasm.ErrBridgeClosed)
+		}
+		if err := b.SetValue("x", 1); !errors.Is(err, wasm.ErrBridgeClosed) {
+			t.Errorf("SetValue after Close: got %v, want %v", err, wasm.ErrBridgeClosed)
+		}
+	})
+}
+
+func TestCloseFromHostFunc(t *testing.T) {
+	forEngines(t, func(t *testing.T, e wasm.Engine) {
+		b := newFunction(t, e)
+		b.SetFunc("addProxy", func(args []interface{}) (interface{}, error) {
+			return nil, b.Close()
+		})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			b.Run(context.Background(), make(chan error, 1))
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Run didn't return once closed by a host function")
+		}
+
+		if _, err := b.CallFunc("multiplier", nil); !errors.Is(err, wasm.ErrBridgeClosed) {
+			t.Errorf("CallFunc after Close: got %v, want %v", err, wasm.ErrBridgeClosed)
+		}
+	})
+}
+
+func TestCloseInterrupts(t *testing.T) {
+	b := startGuest(t, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.CallFunc("spin", nil)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- b.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close waits for a guest that never returns")
+	}
+
+	if err := <-done; !errors.Is(err, wasm.ErrInterrupted) {
+		t.Errorf("spin() once closed: got %v, want %v", err, wasm.ErrInterrupted)
+	}
+}
+
+func TestCallFromHostFunc(t *testing.T) {
+	b := startGuest(t, func(b *wasm.Bridge) {
+		b.SetFunc("myapp.math.double", func(args []interface{}) (interface{}, error) {
+			// the guest waits in this host function, calls may be made
+			// from the goroutine running it and from others
+			res, err := b.CallFunc("sum", []interface{}{wasm.FromFloat64s([]float64{args[0].(float64)})})
+			if err != nil {
+				return nil, err
+			}
+
+			other := make(chan interface{})
+			go func() {
+				res, err := b.CallFunc("sum", []interface{}{wasm.FromFloat64s([]float64{args[0].(float64)})})
+				if err != nil {
+					t.Error(err)
+				}
+				other <- res
+			}()
+			return res.(float64) + (<-other).(float64), nil
+		})
+	})
+
+	res, err := b.CallFunc("double", []interface{}{21})
+	if err != nil || res != float64(42) {
+		t.Errorf("double(21) = %v, %v, want 42", res, err)
+	}
+}
+
+func TestTimers(t *testing.T) {
+	b := startGuest(t, nil)
+	if _, err := b.CallFunc("wake", []interface{}{50}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the guest's timer fires from Run
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if woke, err := b.GetValue("woke"); err == nil && woke == true {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the guest's timer didn't fire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTimeLimit(t *testing.T) {
+	b := startGuest(t, nil, wasm.WithTimeLimit(100*time.Millisecond))
+	if _, err := b.CallFunc("spin", nil); !errors.Is(err, wasm.ErrInterrupted) {
+		t.Errorf("spin() with a time limit: got %v, want %v", err, wasm.ErrInterrupted)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	b := startGuest(t, nil, wasm.WithTimeLimit(time.Hour))
+	time.AfterFunc(100*time.Millisecond, b.Interrupt)
+	if _, err := b.CallFunc("spin", nil); !errors.Is(err, wasm.ErrInterrupted) {
+		t.Errorf("interrupted spin(): got %v, want %v", err, wasm.ErrInterrupted)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	b := newBridge(t, guestModule(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	init := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx, init)
+	}()
+	if err := <-init; err != nil {
+		t.Fatal(err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := b.CallFunc("spin", nil); !errors.Is(err, wasm.ErrInterrupted) {
+		t.Errorf("spin() once Run's context is cancelled: got %v, want %v", err, wasm.ErrInterrupted)
+	}
+	<-done
+}
+
+func TestMaxMemory(t *testing.T) {
+	b := startGuest(t, nil, wasm.WithMaxMemory(64<<20))
+	if res, err := b.CallFunc("alloc", []interface{}{1}); err != nil || res != float64(1<<20) {
+		t.Fatalf("alloc(1) = %v, %v, want %d", res, err, 1<<20)
+	}
+
+	if _, err := b.CallFunc("alloc", []interface{}{128}); !errors.Is(err, wasm.ErrOutOfMemory) {
+		t.Errorf("alloc(128) with 64 MiB: got %v, want %v", err, wasm.ErrOutOfMemory)
+	}
+	if _, err := b.CallFunc("alloc", []interface{}{1}); !errors.Is(err, wasm.ErrBridgeClosed) {
+		t.Errorf("alloc(1) once out of memory: got %v, want %v", err, wasm.ErrBridgeClosed)
+	}
+}
+
+func TestMaxMemoryOnWasmer(t *testing.T) {
+	for _, e := range wasm.Engines() {
+		if e.Name() != "wasmer" {
+			continue
+		}
+
+		_, err := functionModule(t, e).NewBridge("", wasm.WithMaxMemory(64<<20))
+		if err == nil {
+			t.Error("wasmer bridge with a memory limit")
+		}
+	}
+}
+
+func TestTimeLimitOnWasmer(t *testing.T) {
+	for _, e := range wasm.Engines() {
+		if e.Name() != "wasmer" {
+			continue
+		}
+
+		_, err := functionModule(t, e).NewBridge("", wasm.WithTimeLimit(time.Second))
+		if err == nil {
+			t.Error("wasmer bridge with a time limit")
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package wasm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// CompileCached is like CompileModule, but keeps the compiled module in dir.
+// Compiling the same bytes again, by this or another process using the same
+// engine version, loads the module from dir instead. dir is created if needed.
+// Failing to keep the module in dir isn't an error, see Module.CacheErr.
+func CompileCached(dir string, bytes []byte) (*Module, error) {
+	return NewCachedModule(DefaultEngine(), dir, bytes)
+}
+
+// NewCachedModule is like NewModule, but keeps the compiled module in dir if
+// e is a CachingEngine.
+func NewCachedModule(e Engine, dir string, bytes []byte) (*Module, error) {
+	ce, ok := e.(CachingEngine)
+	if !ok {
+		return NewModule(e, bytes)
+	}
+
+	cm, cacheErr, err := ce.CompileCached(dir, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newModule(cm, bytes)
+	m.cacheErr = cacheErr
+	return m, nil
+}
+
+// CacheErr returns why a module compiled by CompileCached or NewCachedModule
+// couldn't be kept in its dir, to be compiled again the next time. It is nil
+// if the module was loaded from dir or kept there.
+func (m *Module) CacheErr() error {
+	return m.cacheErr
+}
+
+// CompileFileCached is like CompileFile, but keeps the compiled module in dir.
+func CompileFileCached(dir, file string) (*Module, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return CompileCached(dir, bytes)
+}
+
+// cacheKey identifies bytes compiled by the given version of an engine.
+func cacheKey(version string, bytes []byte) string {
+	h := sha256.New()
+	h.Write([]byte(version))
+	h.Write([]byte{0})
+	h.Write(bytes)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheError is the CacheErr of a module that couldn't be kept in dir.
+func cacheError(dir string, err error) error {
+	return fmt.Errorf("wasm: can't cache the compiled module in %s: %w", dir, err)
+}
+
+// writeFileAtomic writes data to path through a temporary file, so that
+// concurrent readers never see a partial module.
+func writeFileAtomic(dir, path string, data []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".module-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
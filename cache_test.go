@@ -0,0 +1,93 @@
+package wasm_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestNewCachedModule(t *testing.T) {
+	bytes, err := os.ReadFile(functionWasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forEngines(t, func(t *testing.T, e wasm.Engine) {
+		dir := filepath.Join(t.TempDir(), "cache")
+
+		// compiled and kept, then loaded from dir
+		for i := 0; i < 2; i++ {
+			m, err := wasm.NewCachedModule(e, dir, bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(m.Close)
+			if err := m.CacheErr(); err != nil {
+				t.Errorf("#%d: CacheErr() = %v", i+1, err)
+			}
+
+			b := startBridge(t, m)
+			if res, err := b.CallFunc("multiplier", nil); err != nil || res != float64(10) {
+				t.Errorf("#%d: multiplier() = %v, %v, want 10", i+1, res, err)
+			}
+		}
+
+		if entries, err := os.ReadDir(dir); err != nil || len(entries) == 0 {
+			t.Errorf("nothing kept in the cache: %v", err)
+		}
+	})
+}
+
+func TestNewCachedModuleFallback(t *testing.T) {
+	bytes, err := os.ReadFile(functionWasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forEngines(t, func(t *testing.T, e wasm.Engine) {
+		// a file where the cache's dir should be
+		dir := filepath.Join(t.TempDir(), "cache")
+		if err := os.WriteFile(dir, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := wasm.NewCachedModule(e, dir, bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		if m.CacheErr() == nil {
+			t.Error("CacheErr() = nil for a module that couldn't be kept")
+		}
+
+		// the module works all the same
+		b := startBridge(t, m)
+		if res, err := b.CallFunc("multiplier", nil); err != nil || res != float64(10) {
+			t.Errorf("multiplier() = %v, %v, want 10", res, err)
+		}
+	})
+}
+
+func TestCompileCached(t *testing.T) {
+	dir := t.TempDir()
+	m, err := wasm.CompileFileCached(dir, functionWasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := m.CacheErr(); err != nil {
+		t.Errorf("CacheErr() = %v", err)
+	}
+
+	b := startBridge(t, m)
+	if res, err := b.CallFunc("multiplier", nil); err != nil || res != float64(10) {
+		t.Errorf("multiplier() = %v, %v, want 10", res, err)
+	}
+
+	// not a module of the engine
+	if _, err := wasm.CompileCached(dir, []byte("not wasm")); err == nil {
+		t.Error("CompileCached of invalid bytes succeeded")
+	}
+}
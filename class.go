@@ -0,0 +1,279 @@
+package wasm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	bytesType    = reflect.TypeOf([]byte(nil))
+	float64sType = reflect.TypeOf([]float64(nil))
+)
+
+// SetClass registers a JS class on the global object that is backed by Go values.
+//
+// `new Name(...args)` in the guest calls constructor with the arguments, and the
+// Go value it returns is handed to the guest as an object. Exported methods of the
+// value can be called from the guest and exported struct fields can be read and
+// written as properties. JS style names are mapped to Go names by upper casing
+// the first letter, so `kv.Call("put", k, v)` calls `(*KVStore).Put(k, v)`.
+//
+// Arguments are converted to the parameter types of the method. Methods may
+// return nothing, a value, an error, or a value and an error. A non nil error
+// is thrown in the guest.
+func (b *Bridge) SetClass(name string, constructor Func) error {
+	if constructor == nil {
+		return errors.New("nil constructor")
+	}
+
+	class := &object{name: name}
+	class.new = func(args []interface{}) interface{} {
+		v, err := constructor(args)
+		if err != nil {
+			return err
+		}
+
+		res := toJS(reflect.ValueOf(v))
+		if o, ok := res.(*hostObject); ok {
+			o.class = class
+		}
+		return res
+	}
+	return b.SetValue(name, class)
+}
+
+// hostObject exposes a Go value to the guest.
+type hostObject struct {
+	v     reflect.Value
+	class *object // the class that made it, if any
+
+	// the methods and the objects of fields handed out, so that the guest
+	// gets the same value, and value id, each time it reads them
+	methods  methods
+	fieldsMu sync.Mutex
+	fields   map[string]*hostObject
+}
+
+func (o *hostObject) get(prop string) (interface{}, bool) {
+	name := goName(prop)
+	if m := o.v.MethodByName(name); m.IsValid() {
+		return o.methods.get(prop, func(string) Func { return methodFunc(name, m) }), true
+	}
+
+	f, ok := o.field(name)
+	if !ok {
+		return nil, false
+	}
+
+	v := toJS(f)
+	fo, ok := v.(*hostObject)
+	if !ok {
+		return v, true
+	}
+
+	o.fieldsMu.Lock()
+	defer o.fieldsMu.Unlock()
+	if cached, ok := o.fields[name]; ok && sameValue(cached.v, fo.v) {
+		return cached, true
+	}
+
+	if o.fields == nil {
+		o.fields = map[string]*hostObject{}
+	}
+	o.fields[name] = fo
+	return fo, true
+}
+
+// sameValue reports whether a and b refer to the same Go value.
+func sameValue(a, b reflect.Value) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Map:
+		return a.Pointer() == b.Pointer()
+	case reflect.Slice:
+		return a.Pointer() == b.Pointer() && a.Len() == b.Len()
+	}
+
+	return false
+}
+
+func (o *hostObject) set(prop string, v interface{}) error {
+	name := goName(prop)
+	f, ok := o.field(name)
+	if !ok {
+		return fmt.Errorf("%s has no field %s", o.v.Type(), name)
+	}
+
+	if !f.CanSet() {
+		return fmt.Errorf("field %s of %s cannot be set", name, o.v.Type())
+	}
+
+	fv, err := fromJS(v, f.Type())
+	if err != nil {
+		return fmt.Errorf("field %s: %v", name, err)
+	}
+
+	f.Set(fv)
+	return nil
+}
+
+func (o *hostObject) field(name string) (reflect.Value, bool) {
+	v := o.v
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+
+	sf, ok := v.Type().FieldByName(name)
+	if !ok || sf.PkgPath != "" {
+		return reflect.Value{}, false
+	}
+
+	return v.FieldByIndex(sf.Index), true
+}
+
+// methodFunc wraps a bound method as a Func that converts arguments and results.
+func methodFunc(name string, m reflect.Value) Func {
+	mt := m.Type()
+	return func(args []interface{}) (interface{}, error) {
+		n := mt.NumIn()
+		if mt.IsVariadic() {
+			n--
+		}
+
+		if len(args) < n || (!mt.IsVariadic() && len(args) > n) {
+			return nil, fmt.Errorf("%s: expected %d arguments, got %d", name, n, len(args))
+		}
+
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			t := mt.In(min(i, mt.NumIn()-1))
+			if mt.IsVariadic() && i >= n {
+				t = t.Elem()
+			}
+
+			v, err := fromJS(arg, t)
+			if err != nil {
+				return nil, fmt.Errorf("%s: argument %d: %v", name, i, err)
+			}
+			in[i] = v
+		}
+
+		out := m.Call(in)
+		if len(out) > 0 && mt.Out(len(out)-1) == errorType {
+			errv := out[len(out)-1]
+			out = out[:len(out)-1]
+			if !errv.IsNil() {
+				return nil, errv.Interface().(error)
+			}
+		}
+
+		switch len(out) {
+		case 0:
+			return nil, nil
+		case 1:
+			return toJS(out[0]), nil
+		}
+
+		return nil, fmt.Errorf("%s: too many results", name)
+	}
+}
+
+// fromJS converts a guest value to a Go value of type t.
+func fromJS(v interface{}, t reflect.Type) (reflect.Value, error) {
+	if v == undefined || v == nil {
+		return reflect.Zero(t), nil
+	}
+
+	if o, ok := v.(*hostObject); ok {
+		v = o.v.Interface()
+	}
+
+	switch t {
+	case bytesType:
+		buf, err := Bytes(v)
+		return reflect.ValueOf(buf), err
+	case float64sType:
+		fs, err := Float64s(v)
+		return reflect.ValueOf(fs), err
+	}
+
+	rv := reflect.ValueOf(v)
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if _, ok := v.(float64); !ok {
+			return reflect.Value{}, fmt.Errorf("got %T instead of number", v)
+		}
+		return rv.Convert(t), nil
+	}
+
+	if !rv.Type().AssignableTo(t) {
+		return reflect.Value{}, fmt.Errorf("cannot use %T as %s", v, t)
+	}
+
+	return rv, nil
+}
+
+// toJS converts a Go value to a value the guest understands.
+// Values without a JS counterpart are wrapped as objects.
+func toJS(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Interface:
+		return toJS(v.Elem())
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func:
+		if v.IsNil() {
+			return nil
+		}
+	}
+
+	switch i := v.Interface().(type) {
+	case []byte:
+		return FromBytes(i)
+	case []float64:
+		return FromFloat64s(i)
+	case Func, *Func, Method, *Method, *object, *array, *arrayBuffer, *dataView, *hostObject, *funcWrapper, *[]interface{}:
+		return i
+	case error:
+		return i.Error()
+	}
+
+	if v.Kind() == reflect.Struct && v.CanAddr() {
+		// so that methods with pointer receivers are reachable
+		v = v.Addr()
+	}
+
+	return &hostObject{v: v}
+}
+
+// goName maps a JS property name to the exported Go name.
+func goName(prop string) string {
+	r, n := utf8.DecodeRuneInString(prop)
+	return string(unicode.ToUpper(r)) + prop[n:]
+}
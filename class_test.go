@@ -0,0 +1,107 @@
+package wasm_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+type kvStore struct {
+	prefix string
+	data   map[string]string
+	Puts   int
+	Parent *kvStore
+}
+
+func (kv *kvStore) Put(k, v string) {
+	kv.data[k] = kv.prefix + v
+	kv.Puts++
+}
+
+func (kv *kvStore) Get(k string) string {
+	return kv.data[k]
+}
+
+func startKV(t *testing.T) (*wasm.Bridge, *[]*kvStore) {
+	var stores []*kvStore
+	b := startGuest(t, nil)
+	err := b.SetClass("KVStore", func(args []interface{}) (interface{}, error) {
+		if len(args) == 0 {
+			return nil, errors.New("missing prefix")
+		}
+
+		kv := &kvStore{prefix: args[0].(string), data: map[string]string{}}
+		if len(stores) > 0 {
+			kv.Parent = stores[0]
+		}
+		stores = append(stores, kv)
+		return kv, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b, &stores
+}
+
+func TestSetClass(t *testing.T) {
+	b, stores := startKV(t)
+	res, err := b.CallFunc("kv", []interface{}{"p:", "v"})
+	if err != nil || res != "p:v 1" {
+		t.Errorf("kv(p:, v) = %v, %v, want p:v 1", res, err)
+	}
+	if len(*stores) != 1 || (*stores)[0].Get("k") != "p:v" {
+		t.Errorf("the guest's KVStore isn't the host's: %v", *stores)
+	}
+
+	res, err = b.CallFunc("construct", []interface{}{"KVStore", "p:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, err := wasm.Property(res, "instanceOf"); err != nil || is != true {
+		t.Errorf("new KVStore() instanceof KVStore = %v, %v", is, err)
+	}
+
+	kv, err := wasm.Property(res, "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same function or object each time, not a new value id to be released
+	for _, prop := range []string{"get", "parent"} {
+		if same, err := b.CallFunc("sameProp", []interface{}{kv, prop}); err != nil || same != true {
+			t.Errorf("KVStore.%s read twice is the same value: %v, %v", prop, same, err)
+		}
+	}
+
+	if _, err := b.CallFunc("setProp", []interface{}{kv, "puts", 7}); err != nil {
+		t.Fatal(err)
+	}
+	if puts := (*stores)[1].Puts; puts != 7 {
+		t.Errorf("Puts = %d once set by the guest, want 7", puts)
+	}
+}
+
+func TestSetClassError(t *testing.T) {
+	b, stores := startKV(t)
+	res, err := b.CallFunc("construct", []interface{}{"KVStore"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{"thrown": "Error", "message": "missing prefix"}
+	for prop, v := range want {
+		if got, err := wasm.Property(res, prop); err != nil || got != v {
+			t.Errorf("new KVStore() threw %s %v, %v, want %v", prop, got, err, v)
+		}
+	}
+	if len(*stores) != 0 {
+		t.Errorf("failed constructor made %d stores", len(*stores))
+	}
+
+	// the guest caught the error and carries on
+	if res, err := b.CallFunc("kv", []interface{}{"p:", "v"}); err != nil || res != "p:v 1" {
+		t.Errorf("kv(p:, v) = %v, %v, want p:v 1", res, err)
+	}
+}
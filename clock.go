@@ -0,0 +1,135 @@
+package wasm
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the guest's source of time. It backs the guest's clocks, Date and
+// the timers behind time.Sleep, time.After and friends.
+type Clock interface {
+	Now() time.Time
+
+	// AfterFunc calls f once d has passed, unless stop is called first. f
+	// blocks until the guest has handled the timer, so it must not be called
+	// with locks held. stop reports whether it stopped the call.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// WithClock makes the guest see the time of c instead of the real one.
+// Together with WithRandom and a FakeClock it makes a guest deterministic.
+func WithClock(c Clock) Option {
+	return func(b *Bridge) {
+		b.clock = c
+	}
+}
+
+// WithRandom makes the guest read its random bytes from r instead of
+// crypto/rand, e.g. from rand.New(rand.NewSource(seed)) to replay a run.
+// r is only read by one goroutine at a time.
+func WithRandom(r io.Reader) Option {
+	return func(b *Bridge) {
+		b.random = r
+	}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) (stop func() bool) {
+	return time.AfterFunc(d, f).Stop
+}
+
+// FakeClock is a Clock that only moves when told to. The guest's timers
+// expire as Advance moves past them.
+//
+// A FakeClock is safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    int
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	when time.Time
+	seq  int
+	f    func()
+}
+
+// NewFakeClock returns a FakeClock set to now. Its location is the guest's time zone.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc arranges for f to be called once Advance moves the clock d past now.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) (stop func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &fakeTimer{when: c.now.Add(d), seq: c.seq, f: f}
+	c.timers = append(c.timers, t)
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, ct := range c.timers {
+			if ct == t {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// Advance moves the clock forward by d. The timers expiring on the way are
+// fired one by one in order, with the clock set to their expiry, including
+// those scheduled by the guest while handling earlier ones. Advance returns
+// once the guest has handled them.
+//
+// Advance must not be called from a host function, the guest can't handle
+// its timers while it is calling the host.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.Slice(c.timers, func(i, j int) bool {
+			ti, tj := c.timers[i], c.timers[j]
+			if ti.when.Equal(tj.when) {
+				return ti.seq < tj.seq
+			}
+
+			return ti.when.Before(tj.when)
+		})
+
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+
+	c.now = end
+	c.mu.Unlock()
+}
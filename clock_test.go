@@ -0,0 +1,45 @@
+package wasm_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestDeterministic(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var randoms []interface{}
+	for i := 0; i < 2; i++ {
+		clock := wasm.NewFakeClock(start)
+		b := startGuest(t, nil, wasm.WithClock(clock), wasm.WithRandom(rand.New(rand.NewSource(1))))
+		res, err := b.CallFunc("now", nil)
+		if err != nil || res != "2020-01-02T03:04:05Z" {
+			t.Errorf("now() = %v, %v, want the fake clock's", res, err)
+		}
+
+		res, err = b.CallFunc("random", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		randoms = append(randoms, res)
+
+		// the guest's timers expire as the clock is advanced
+		if _, err := b.CallFunc("wake", []interface{}{1000}); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(999 * time.Millisecond)
+		if woke, _ := b.GetValue("woke"); woke == true {
+			t.Error("guest woke early")
+		}
+		clock.Advance(time.Millisecond)
+		if woke, err := b.GetValue("woke"); err != nil || woke != true {
+			t.Errorf("guest didn't wake once the clock advanced: %v, %v", woke, err)
+		}
+	}
+
+	if randoms[0] != randoms[1] {
+		t.Errorf("random() with the same seed = %v and %v", randoms[0], randoms[1])
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// timeoutGrace is how long after -test.timeout a test binary is stopped, so
+// that the testing package gets to report which test hung first.
+const timeoutGrace = 5 * time.Second
+
+// testFileFlags are the flags of test binaries naming files they write, the
+// directories of which are mounted.
+var testFileFlags = []string{"testlogfile", "coverprofile", "cpuprofile", "memprofile", "blockprofile", "mutexprofile", "trace"}
+
+// testFlag returns the value of the -test.name flag in the args of a test
+// binary, and whether it is there.
+func testFlag(args []string, name string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+
+		arg = trimDashes(arg)
+		if arg == "test."+name && i+1 < len(args) {
+			return args[i+1], true
+		}
+		if v, ok := strings.CutPrefix(arg, "test."+name+"="); ok {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+// isTest reports whether args are those of a test binary, run by go test.
+func isTest(args []string) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") && strings.HasPrefix(trimDashes(arg), "test.") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trimDashes returns the flag arg without its leading dashes, one or two.
+func trimDashes(arg string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+}
+
+// testMounts returns the directories a test binary needs besides its
+// package's: the module the package is in, for tests that reach out of
+// testdata, the temporary directory of t.TempDir, and those of the files the
+// test binary is asked to write, like the log go test caches results with.
+func testMounts(dir string, args []string) []string {
+	mounts := []string{os.TempDir()}
+	if root := moduleRoot(dir); root != "" {
+		mounts = append(mounts, root)
+	}
+
+	for _, name := range testFileFlags {
+		if v, ok := testFlag(args, name); ok && filepath.IsAbs(v) {
+			mounts = append(mounts, filepath.Dir(v))
+		}
+	}
+
+	for _, name := range []string{"outputdir", "gocoverdir"} {
+		if v, ok := testFlag(args, name); ok && filepath.IsAbs(v) {
+			mounts = append(mounts, v)
+		}
+	}
+
+	return mounts
+}
+
+// moduleRoot returns the directory of the go.mod of the package in dir, or
+// "" if it isn't in a module.
+func moduleRoot(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// testTimeout returns how long the test binary may run, 0 if there is no limit.
+func testTimeout(args []string) time.Duration {
+	v, ok := testFlag(args, "timeout")
+	if !ok {
+		return 0
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0
+	}
+
+	return d + timeoutGrace
+}
@@ -0,0 +1,148 @@
+// Command go-wasm runs Go programs built with GOOS=js GOARCH=wasm, without
+// Node.js. It stands for go_js_wasm_exec:
+//
+//	go-wasm [flags] prog.wasm [args...]
+//
+// The program gets args, the environment, stdin, stdout and stderr of go-wasm,
+// and the current directory as its working directory. It sees no other files
+// unless -mount says so. go-wasm exits with the program's exit code.
+//
+// go run and go test use it with -exec, or when it is on the PATH as
+// go_js_wasm_exec:
+//
+//	GOOS=js GOARCH=wasm go run -exec go-wasm .
+//	GOOS=js GOARCH=wasm go test -exec go-wasm ./...
+//
+// Test binaries run in their package's directory and also get the module it
+// is in, the temporary directory and the directories of the files go test has
+// them write. They are stopped shortly after their -test.timeout, even when
+// busy.
+//
+// Programs run on wazero unless -engine says otherwise: wasmer can't run those
+// built with Go 1.20 and later, nor stop a busy program.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+var (
+	engine = flag.String("engine", wasm.WazeroEngine().Name(), "engine to run the program on, "+engineNames())
+	dir    = flag.String("dir", ".", "working directory of the program")
+	limit  = flag.Duration("timeout", 0, "stop the program after this long, 0 for no limit (default -test.timeout for tests)")
+	mounts []string
+)
+
+func main() {
+	flag.Func("mount", "host directory the program can use, at the same path (repeatable)", func(dir string) error {
+		mounts = append(mounts, dir)
+		return nil
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: go-wasm [flags] prog.wasm [args...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	os.Exit(run(flag.Arg(0), flag.Args()))
+}
+
+// run runs the program in file with args and returns its exit code.
+func run(file string, args []string) int {
+	opts := []wasm.Option{
+		wasm.WithArgs(args...),
+		wasm.WithEnv(os.Environ()...),
+		wasm.WithStdio(os.Stdin, os.Stdout, os.Stderr),
+		wasm.WithDir(*dir),
+		wasm.WithExitOnDeadlock(),
+	}
+	for _, m := range mounts {
+		opts = append(opts, wasm.WithMount(m))
+	}
+
+	timeout := *limit
+	if isTest(args[1:]) {
+		for _, m := range testMounts(*dir, args[1:]) {
+			opts = append(opts, wasm.WithMount(m))
+		}
+		if timeout == 0 {
+			timeout = testTimeout(args[1:])
+		}
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	e, err := engineByName(*engine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "go-wasm:", err)
+		return 2
+	}
+	opts = append(opts, wasm.WithEngine(e))
+
+	b, err := wasm.BridgeFromFile(file, file, opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "go-wasm:", err)
+		return 1
+	}
+
+	init := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx, init)
+	}()
+	err = <-init
+	<-done
+	if err == nil {
+		err = b.Err()
+	}
+
+	if ctx.Err() != nil && (err == nil || errors.Is(err, wasm.ErrInterrupted)) {
+		fmt.Fprintf(os.Stderr, "go-wasm: %s timed out after %v\n", file, timeout)
+		return 2
+	}
+
+	// the runtime reported its panic itself before exiting
+	var trap *wasm.GuestTrap
+	if err != nil && !(errors.As(err, &trap) && trap.Err == nil) {
+		fmt.Fprintln(os.Stderr, "go-wasm:", err)
+		return 1
+	}
+
+	return b.ExitCode()
+}
+
+func engineByName(name string) (wasm.Engine, error) {
+	for _, e := range wasm.Engines() {
+		if e.Name() == name {
+			return e, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown engine %s, want %s", name, engineNames())
+}
+
+func engineNames() string {
+	var names []string
+	for _, e := range wasm.Engines() {
+		names = append(names, e.Name())
+	}
+
+	return strings.Join(names, " or ")
+}
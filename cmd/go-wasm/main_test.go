@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGoTest(t *testing.T) {
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command")
+	}
+
+	bin := filepath.Join(t.TempDir(), "go-wasm")
+	if out, err := exec.Command(goCmd, "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("building go-wasm: %v\n%s", err, out)
+	}
+
+	goTest := func(env []string, args ...string) (string, error) {
+		cmd := exec.Command(goCmd, append([]string{"test", "-exec", bin, "-count=1"}, args...)...)
+		cmd.Dir = "testdata/gotest"
+		cmd.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm", "GOWORK=off")
+		cmd.Env = append(cmd.Env, env...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	out, err := goTest(nil, "-v", ".")
+	if err != nil {
+		t.Fatalf("go test: %v\n%s", err, out)
+	}
+	for _, want := range []string{"--- PASS: TestTestdata", "--- PASS: TestTempDir", "--- SKIP: TestHang"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("go test -v output lacks %q:\n%s", want, out)
+		}
+	}
+
+	out, err = goTest([]string{"GOTEST_FAIL=1"}, "-run", "Fail", ".")
+	if err == nil || !strings.Contains(out, "failing as asked") || strings.Contains(out, "TestTestdata") {
+		t.Errorf("go test -run Fail of a failing test: %v\n%s", err, out)
+	}
+
+	out, err = goTest([]string{"GOTEST_HANG=1"}, "-run", "Hang", "-timeout", "1s", ".")
+	if err == nil || !strings.Contains(out, "timed out") {
+		t.Errorf("go test of a hanging test: %v\n%s", err, out)
+	}
+}
+
+func TestTestFlag(t *testing.T) {
+	tests := []struct {
+		args  []string
+		value string
+		ok    bool
+	}{
+		{[]string{"-test.timeout=10s"}, "10s", true},
+		{[]string{"--test.timeout", "10s"}, "10s", true},
+		{[]string{"-test.v", "-test.timeout", "1m"}, "1m", true},
+		{[]string{"-test.v"}, "", false},
+		{[]string{"--", "-test.timeout=10s"}, "", false},
+	}
+
+	for _, test := range tests {
+		v, ok := testFlag(test.args, "timeout")
+		if v != test.value || ok != test.ok {
+			t.Errorf("testFlag(%q, timeout) = %q, %v, want %q, %v", test.args, v, ok, test.value, test.ok)
+		}
+	}
+}
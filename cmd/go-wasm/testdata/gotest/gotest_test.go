@@ -0,0 +1,41 @@
+// Package gotest is run by the tests of go-wasm with go test -exec go-wasm.
+package gotest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTestdata(t *testing.T) {
+	data, err := os.ReadFile("testdata/greeting.txt")
+	if err != nil || string(data) != "hello from testdata\n" {
+		t.Fatalf("reading testdata: %q, %v", data, err)
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(p, []byte("temp"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(p); err != nil || string(data) != "temp" {
+		t.Fatalf("reading %s: %q, %v", p, data, err)
+	}
+}
+
+func TestFail(t *testing.T) {
+	if os.Getenv("GOTEST_FAIL") != "" {
+		t.Fatal("failing as asked")
+	}
+}
+
+func TestHang(t *testing.T) {
+	if os.Getenv("GOTEST_HANG") == "" {
+		t.Skip("not asked to hang")
+	}
+
+	for {
+	}
+}
@@ -0,0 +1,106 @@
+package wasm
+
+// Engine compiles wasm modules. The bridge only talks to the wasm runtime
+// through Engine, CompiledModule and Instance, so that it can run on wasmer
+// through cgo as well as on the pure Go wazero, or on any other runtime
+// implementing them. Package enginetest checks an implementation against the
+// example guests.
+type Engine interface {
+	// Name identifies the engine in diagnostics.
+	Name() string
+	Compile(bytes []byte) (CompiledModule, error)
+}
+
+// CachingEngine is implemented by the engines that can keep compiled modules on disk.
+type CachingEngine interface {
+	Engine
+
+	// CompileCached is like Compile, but keeps the compiled module in dir.
+	// A module that couldn't be kept is returned all the same, with the
+	// reason in cacheErr.
+	CompileCached(dir string, bytes []byte) (m CompiledModule, cacheErr, err error)
+}
+
+// CompiledModule is a module compiled by an Engine.
+type CompiledModule interface {
+	// Instantiate creates an instance whose imports in the "go" namespace, or
+	// "gojs" for guests built with Go 1.21 and later, call the functions in
+	// imports by name. Each function receives the guest's sp,
+	// and aborts the guest by panicking, which Call must recover.
+	// It fails if the module imports a function missing from imports, or if
+	// the engine can't enforce cfg.
+	Instantiate(imports map[string]func(sp int32), cfg InstanceConfig) (Instance, error)
+
+	// Close frees the module. Instances created from it must keep working.
+	Close()
+}
+
+// InstanceConfig limits an Instance.
+type InstanceConfig struct {
+	// MaxMemory caps the guest's linear memory, in bytes. 0 leaves it to the engine.
+	MaxMemory int
+
+	// Interruptible asks for an instance whose Interrupt aborts a running guest.
+	Interruptible bool
+}
+
+// Instance is an instantiated CompiledModule. It is only used by one goroutine at a time.
+type Instance interface {
+	// Memory returns the guest's linear memory. The slice is only valid until
+	// the guest runs again, as it may grow the memory.
+	Memory() []byte
+
+	// Call calls the exported function name. Results are truncated to int32,
+	// the exports the bridge uses take and return nothing else. The imports
+	// may call Memory and Call while the guest is calling them.
+	// Once the guest was refused memory beyond MaxMemory, Call fails with an
+	// error wrapping ErrOutOfMemory, and once it was interrupted with an error
+	// wrapping ErrInterrupted. Other traps are reported as a *GuestTrap with
+	// the reason and, if the engine knows it, the guest's stack.
+	Call(name string, args ...int32) (int32, error)
+
+	// Interrupt aborts the running guest, or the next one to run. The instance
+	// can't be used afterwards. It may be called from any goroutine, at any
+	// time, even after Close. Engines that can't interrupt a guest ignore it,
+	// and fail Instantiate when asked for an Interruptible instance.
+	Interrupt()
+	Close()
+}
+
+// Sampler is implemented by the instances whose guest can be profiled.
+type Sampler interface {
+	// Sample has f called with the guest's stack, innermost function first,
+	// the next time the guest calls one of its functions. It replaces the
+	// previous request, nil cancels it. f is called by the goroutine running
+	// the guest.
+	Sample(f func(stack []string))
+}
+
+// Snapshotter is implemented by the instances whose state can be saved and
+// restored into another instance of the same module.
+type Snapshotter interface {
+	// Globals returns the values of the guest's globals.
+	Globals() []uint64
+
+	// Restore sets the guest's memory, growing it as needed, and its mutable globals.
+	Restore(memory []byte, globals []uint64) error
+}
+
+// DefaultEngine returns the engine used unless WithEngine says otherwise:
+// wasmer when built with cgo and wazero otherwise.
+func DefaultEngine() Engine {
+	return defaultEngine()
+}
+
+// Engines returns the engines available in this build, starting with DefaultEngine.
+func Engines() []Engine {
+	return engines()
+}
+
+// WithEngine makes BridgeFromBytes and BridgeFromFile compile on e instead of
+// the DefaultEngine. Use NewModule for a Module.
+func WithEngine(e Engine) Option {
+	return func(b *Bridge) {
+		b.engine = e
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !cgo
+// +build !cgo
+
+package wasm
+
+func defaultEngine() Engine {
+	return wazeroEngine{}
+}
+
+func engines() []Engine {
+	return []Engine{wazeroEngine{}}
+}
@@ -0,0 +1,22 @@
+package wasm_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+	"github.com/vedhavyas/go-wasm/enginetest"
+)
+
+func TestEngines(t *testing.T) {
+	function, err := os.ReadFile(functionWasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wasmer only runs guests of Go 1.19 and earlier
+	g := enginetest.Guests{Function: function, HTTP: buildGuest(t, "examples/http-wasm", legacyGo)}
+	forEngines(t, func(t *testing.T, e wasm.Engine) {
+		enginetest.Run(t, e, g)
+	})
+}
@@ -0,0 +1,451 @@
+//go:build cgo
+// +build cgo
+
+package wasm
+
+/*
+#include <stdlib.h>
+
+extern void debug(void *context, int32_t a);
+extern void wexit(void *context, int32_t a);
+extern void wwrite(void *context, int32_t a);
+extern void nanotime(void *context, int32_t a);
+extern void nanotime1(void *context, int32_t a);
+extern void walltime(void *context, int32_t a);
+extern void walltime1(void *context, int32_t a);
+extern void resetMemoryDataView(void *context, int32_t a);
+extern void scheduleCallback(void *context, int32_t a);
+extern void clearScheduledCallback(void *context, int32_t a);
+extern void getRandomData(void *context, int32_t a);
+extern void finalizeRef(void *context, int32_t a);
+extern void stringVal(void *context, int32_t a);
+extern void valueGet(void *context, int32_t a);
+extern void valueSet(void *context, int32_t a);
+extern void valueDelete(void *context, int32_t a);
+extern void valueIndex(void *context, int32_t a);
+extern void valueSetIndex(void *context, int32_t a);
+extern void valueCall(void *context, int32_t a);
+extern void valueInvoke(void *context, int32_t a);
+extern void valueNew(void *context, int32_t a);
+extern void valueLength(void *context, int32_t a);
+extern void valuePrepareString(void *context, int32_t a);
+extern void valueLoadString(void *context, int32_t a);
+extern void valueInstanceOf(void *context, int32_t a);
+extern void scheduleTimeoutEvent(void *context, int32_t a);
+extern void clearTimeoutEvent(void *context, int32_t a);
+extern void copyBytesToGo (void *context, int32_t a);
+extern void copyBytesToJS (void *context, int32_t a);
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	rdebug "runtime/debug"
+	"strings"
+	"unsafe"
+
+	"github.com/wasmerio/go-ext-wasm/wasmer"
+)
+
+func defaultEngine() Engine {
+	return wasmerEngine{}
+}
+
+func engines() []Engine {
+	return []Engine{wasmerEngine{}, wazeroEngine{}}
+}
+
+// WasmerEngine returns the engine running modules on wasmer. It needs cgo,
+// and is only available in builds with it. It runs guests built with Go 1.13
+// to 1.19, see WazeroEngine for later versions.
+func WasmerEngine() Engine {
+	return wasmerEngine{}
+}
+
+type wasmerEngine struct{}
+
+func (wasmerEngine) Name() string {
+	return "wasmer"
+}
+
+func (wasmerEngine) Compile(bytes []byte) (CompiledModule, error) {
+	m, err := wasmerCompile(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wasmerModule{module: m}, nil
+}
+
+// wasmerCompile compiles bytes, failing with wasmer's reason. The wasmer this
+// engine is built on predates the bulk memory operations Go 1.20 and later
+// emit, their guests only run on wazero.
+func wasmerCompile(bytes []byte) (wasmer.Module, error) {
+	m, err := wasmer.Compile(bytes)
+	if err != nil {
+		if reason, lerr := wasmer.GetLastError(); lerr == nil && reason != "" {
+			err = fmt.Errorf("wasmer: %s", reason)
+		}
+		if strings.Contains(err.Error(), "bulk memory") {
+			err = fmt.Errorf("%w (guests built with Go 1.20 or later need WazeroEngine)", err)
+		}
+		return m, err
+	}
+
+	return m, nil
+}
+
+const wasmerPath = "github.com/wasmerio/go-ext-wasm"
+
+// wasmerVersion identifies the compiler of the cached modules. Modules
+// serialised by one version of wasmer can't be loaded by another.
+var wasmerVersion = func() string {
+	v := "unknown"
+	if info, ok := rdebug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == wasmerPath {
+				v = dep.Version
+				if dep.Replace != nil {
+					v = dep.Replace.Path + "@" + dep.Replace.Version
+				}
+			}
+		}
+	}
+
+	return wasmerPath + "@" + v + " " + runtime.GOOS + "/" + runtime.GOARCH
+}()
+
+// CompileCached keeps the serialised module in dir, keyed by the wasmer
+// version and the bytes.
+func (wasmerEngine) CompileCached(dir string, bytes []byte) (CompiledModule, error, error) {
+	path := filepath.Join(dir, cacheKey(wasmerVersion, bytes)+".module")
+	if data, err := os.ReadFile(path); err == nil {
+		m, err := wasmer.DeserializeModule(data)
+		if err == nil {
+			return &wasmerModule{module: m}, nil, nil
+		}
+
+		// corrupt or stale entry, compile and replace it
+	}
+
+	m, err := wasmerCompile(bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the module is usable without its cache entry
+	data, err := m.Serialize()
+	if err == nil {
+		err = writeFileAtomic(dir, path, data)
+	}
+	if err != nil {
+		return &wasmerModule{module: m}, cacheError(dir, err), nil
+	}
+
+	return &wasmerModule{module: m}, nil, nil
+}
+
+type wasmerModule struct {
+	module wasmer.Module
+}
+
+var wasmerImports = []struct {
+	name string
+	imp  interface{}
+	cgo  unsafe.Pointer
+}{
+	{"debug", debug, C.debug},
+	{"runtime.wasmExit", wexit, C.wexit},
+	{"runtime.wasmWrite", wwrite, C.wwrite},
+	{"runtime.nanotime", nanotime, C.nanotime},
+	{"runtime.nanotime1", nanotime1, C.nanotime1},
+	{"runtime.walltime", walltime, C.walltime},
+	{"runtime.walltime1", walltime1, C.walltime1},
+	{"runtime.resetMemoryDataView", resetMemoryDataView, C.resetMemoryDataView},
+	{"runtime.scheduleCallback", scheduleCallback, C.scheduleCallback},
+	{"runtime.clearScheduledCallback", clearScheduledCallback, C.clearScheduledCallback},
+	{"runtime.getRandomData", getRandomData, C.getRandomData},
+	{"runtime.scheduleTimeoutEvent", scheduleTimeoutEvent, C.scheduleTimeoutEvent},
+	{"runtime.clearTimeoutEvent", clearTimeoutEvent, C.clearTimeoutEvent},
+	{"syscall/js.finalizeRef", finalizeRef, C.finalizeRef},
+	{"syscall/js.stringVal", stringVal, C.stringVal},
+	{"syscall/js.valueGet", valueGet, C.valueGet},
+	{"syscall/js.valueSet", valueSet, C.valueSet},
+	{"syscall/js.valueDelete", valueDelete, C.valueDelete},
+	{"syscall/js.valueIndex", valueIndex, C.valueIndex},
+	{"syscall/js.valueSetIndex", valueSetIndex, C.valueSetIndex},
+	{"syscall/js.valueCall", valueCall, C.valueCall},
+	{"syscall/js.valueInvoke", valueInvoke, C.valueInvoke},
+	{"syscall/js.valueNew", valueNew, C.valueNew},
+	{"syscall/js.valueLength", valueLength, C.valueLength},
+	{"syscall/js.valuePrepareString", valuePrepareString, C.valuePrepareString},
+	{"syscall/js.valueLoadString", valueLoadString, C.valueLoadString},
+	{"syscall/js.valueInstanceOf", valueInstanceOf, C.valueInstanceOf},
+	{"syscall/js.copyBytesToGo", copyBytesToGo, C.copyBytesToGo},
+	{"syscall/js.copyBytesToJS", copyBytesToJS, C.copyBytesToJS},
+}
+
+func (m *wasmerModule) Instantiate(imports map[string]func(sp int32), cfg InstanceConfig) (Instance, error) {
+	if cfg.MaxMemory > 0 {
+		return nil, errors.New("wasmer can't limit the memory of an instance")
+	}
+
+	if cfg.Interruptible {
+		return nil, errors.New("wasmer can't interrupt an instance")
+	}
+
+	// only the functions the guest imports are given to it, Go 1.13 and later
+	// versions import different sets
+	imported := make(map[string]bool)
+	for _, imp := range m.module.Imports {
+		if imp.Namespace == "go" && imp.Kind == wasmer.ImportExportKindFunction {
+			imported[imp.Name] = true
+		}
+	}
+
+	imps := wasmer.NewImports().Namespace("go")
+	var err error
+	for _, imp := range wasmerImports {
+		if !imported[imp.name] {
+			continue
+		}
+
+		if imports[imp.name] == nil {
+			return nil, fmt.Errorf("missing import go.%s", imp.name)
+		}
+
+		imps, err = imps.Append(imp.name, imp.imp, imp.cgo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	inst, err := m.module.InstantiateWithImports(imps)
+	if err != nil {
+		return nil, err
+	}
+
+	wi := &wasmerInstance{inst: inst, imports: imports}
+	inst.SetContextData(wi)
+	return wi, nil
+}
+
+func (m *wasmerModule) Close() {
+	m.module.Close()
+}
+
+type wasmerInstance struct {
+	inst    wasmer.Instance
+	imports map[string]func(sp int32)
+}
+
+func (wi *wasmerInstance) Memory() []byte {
+	return wi.inst.Memory.Data()
+}
+
+func (wi *wasmerInstance) Call(name string, args ...int32) (res int32, err error) {
+	fn, ok := wi.inst.Exports[name]
+	if !ok {
+		return 0, fmt.Errorf("missing export %s", name)
+	}
+
+	in := make([]interface{}, len(args))
+	for i, arg := range args {
+		in[i] = arg
+	}
+
+	// wasmer keeps the reason of a trap per thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// wasmer can't trap from an import, an aborting import panics through the
+	// guest's frames instead
+	defer func() {
+		if r := recover(); r != nil {
+			err, _ = r.(error)
+			if err == nil {
+				err = fmt.Errorf("%v", r)
+			}
+			err = &GuestTrap{Reason: err.Error(), Err: err}
+		}
+	}()
+	v, err := fn(in...)
+	if err != nil {
+		// wasmer doesn't report the guest's stack
+		reason, lerr := wasmer.GetLastError()
+		if lerr != nil {
+			reason = err.Error()
+		}
+		return 0, &GuestTrap{Reason: strings.TrimPrefix(reason, "Call error: "), Err: err}
+	}
+
+	if v.GetType() != wasmer.TypeI32 {
+		return 0, nil
+	}
+
+	return v.ToI32(), nil
+}
+
+func (wi *wasmerInstance) Interrupt() {}
+
+// Close frees the instance. wasmer keeps the context data of an instance in a
+// package level map until the instance is collected, and that entry would keep
+// the instance alive.
+func (wi *wasmerInstance) Close() {
+	wi.inst.SetContextData(nil)
+	wi.inst.Close()
+}
+
+// callImport dispatches a call by the guest to the import name of the instance that made it.
+func callImport(ctx unsafe.Pointer, name string, sp int32) {
+	ictx := wasmer.IntoInstanceContext(ctx)
+	ictx.Data().(*wasmerInstance).imports[name](sp)
+}
+
+//export debug
+func debug(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "debug", sp)
+}
+
+//export wexit
+func wexit(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.wasmExit", sp)
+}
+
+//export wwrite
+func wwrite(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.wasmWrite", sp)
+}
+
+//export nanotime
+func nanotime(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.nanotime", sp)
+}
+
+//export nanotime1
+func nanotime1(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.nanotime1", sp)
+}
+
+//export walltime
+func walltime(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.walltime", sp)
+}
+
+//export walltime1
+func walltime1(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.walltime1", sp)
+}
+
+//export resetMemoryDataView
+func resetMemoryDataView(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.resetMemoryDataView", sp)
+}
+
+//export scheduleCallback
+func scheduleCallback(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.scheduleCallback", sp)
+}
+
+//export clearScheduledCallback
+func clearScheduledCallback(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.clearScheduledCallback", sp)
+}
+
+//export getRandomData
+func getRandomData(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.getRandomData", sp)
+}
+
+//export scheduleTimeoutEvent
+func scheduleTimeoutEvent(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.scheduleTimeoutEvent", sp)
+}
+
+//export clearTimeoutEvent
+func clearTimeoutEvent(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "runtime.clearTimeoutEvent", sp)
+}
+
+//export finalizeRef
+func finalizeRef(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.finalizeRef", sp)
+}
+
+//export stringVal
+func stringVal(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.stringVal", sp)
+}
+
+//export valueGet
+func valueGet(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valueGet", sp)
+}
+
+//export valueSet
+func valueSet(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valueSet", sp)
+}
+
+//export valueDelete
+func valueDelete(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valueDelete", sp)
+}
+
+//export valueIndex
+func valueIndex(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valueIndex", sp)
+}
+
+//export valueSetIndex
+func valueSetIndex(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valueSetIndex", sp)
+}
+
+//export valueCall
+func valueCall(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valueCall", sp)
+}
+
+//export valueInvoke
+func valueInvoke(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valueInvoke", sp)
+}
+
+//export valueNew
+func valueNew(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valueNew", sp)
+}
+
+//export valueLength
+func valueLength(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valueLength", sp)
+}
+
+//export valuePrepareString
+func valuePrepareString(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valuePrepareString", sp)
+}
+
+//export valueLoadString
+func valueLoadString(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valueLoadString", sp)
+}
+
+//export valueInstanceOf
+func valueInstanceOf(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.valueInstanceOf", sp)
+}
+
+//export copyBytesToGo
+func copyBytesToGo(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.copyBytesToGo", sp)
+}
+
+//export copyBytesToJS
+func copyBytesToJS(ctx unsafe.Pointer, sp int32) {
+	callImport(ctx, "syscall/js.copyBytesToJS", sp)
+}
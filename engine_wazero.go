@@ -0,0 +1,492 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// WazeroEngine returns the engine running modules on wazero, which is pure Go
+// and needs no cgo. It runs guests built with Go 1.13 and later.
+func WazeroEngine() Engine {
+	return wazeroEngine{}
+}
+
+// WazeroProfilingEngine returns wazero set up for the guests to be profiled
+// with StartProfile. Calls between the guest's functions are slower on it.
+func WazeroProfilingEngine() Engine {
+	return wazeroEngine{profiling: true}
+}
+
+type wazeroEngine struct {
+	profiling bool
+}
+
+func (e wazeroEngine) Name() string {
+	if e.profiling {
+		return "wazero-profiling"
+	}
+
+	return "wazero"
+}
+
+func (e wazeroEngine) Compile(bytes []byte) (CompiledModule, error) {
+	return newWazeroModule(bytes, nil, e.profiling)
+}
+
+// CompileCached keeps the compiled module in dir. wazero keys the entries by
+// its own version and the bytes.
+func (e wazeroEngine) CompileCached(dir string, bytes []byte) (CompiledModule, error, error) {
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		m, cerr := e.Compile(bytes)
+		return m, cacheError(dir, err), cerr
+	}
+
+	m, err := newWazeroModule(bytes, cache, e.profiling)
+	if err != nil {
+		cache.Close(context.Background())
+
+		// wazero fails the compilation when it can't write the cache entry
+		m, cerr := e.Compile(bytes)
+		if cerr != nil {
+			return nil, nil, cerr
+		}
+
+		return m, cacheError(dir, err), nil
+	}
+
+	return m, nil, nil
+}
+
+// wazeroModule owns a runtime of its own, holding the "go" host module its
+// instances import from. Closing the runtime closes all the instances in it,
+// so it is only closed once the module and all of its instances are.
+type wazeroModule struct {
+	rt       wazero.Runtime
+	cache    wazero.CompilationCache
+	compiled wazero.CompiledModule
+	imports  []string // of the "go" or "gojs" namespace
+	globals  int      // exported as globalExport, for snapshots
+
+	// profiling modules have a sampler in the context of their instances
+	profiling bool
+
+	mu   sync.Mutex
+	refs int
+}
+
+// importsKey is the context key of the imports of the instance being called.
+type importsKey struct{}
+
+func newWazeroModule(bytes []byte, cache wazero.CompilationCache, profiling bool) (*wazeroModule, error) {
+	ctx := context.Background()
+	cfg := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if cache != nil {
+		cfg = cfg.WithCompilationCache(cache)
+	}
+
+	m := &wazeroModule{rt: wazero.NewRuntimeWithConfig(ctx, cfg), cache: cache, profiling: profiling, refs: 1}
+	cctx := ctx
+	if profiling {
+		// listeners are compiled in
+		cctx = experimental.WithFunctionListenerFactory(ctx, sampleListener{})
+	}
+
+	bytes, m.globals = exportGlobals(bytes)
+	compiled, err := m.rt.CompileModule(cctx, bytes)
+	if err != nil {
+		m.rt.Close(ctx)
+		return nil, err
+	}
+
+	m.compiled = compiled
+
+	// the host functions are shared by all the instances, each call is
+	// dispatched to the imports of the instance in the context. Go 1.21 and
+	// later import them from gojs.
+	namespace := "go"
+	for _, fn := range compiled.ImportedFunctions() {
+		if mod, _, _ := fn.Import(); mod == "gojs" {
+			namespace = mod
+		}
+	}
+
+	host := m.rt.NewHostModuleBuilder(namespace)
+	for _, fn := range compiled.ImportedFunctions() {
+		mod, name, _ := fn.Import()
+		if mod != namespace {
+			continue
+		}
+
+		m.imports = append(m.imports, name)
+		host.NewFunctionBuilder().
+			WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, _ api.Module, stack []uint64) {
+				ctx.Value(importsKey{}).(map[string]func(sp int32))[name](api.DecodeI32(stack[0]))
+			}), []api.ValueType{api.ValueTypeI32}, nil).
+			Export(name)
+	}
+
+	if _, err := host.Instantiate(ctx); err != nil {
+		m.rt.Close(ctx)
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *wazeroModule) Instantiate(imports map[string]func(sp int32), cfg InstanceConfig) (Instance, error) {
+	for _, name := range m.imports {
+		if imports[name] == nil {
+			return nil, fmt.Errorf("missing import go.%s", name)
+		}
+	}
+
+	// the guest runs with ctx, cancelling it interrupts the guest
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), importsKey{}, imports))
+	var sampler *wazeroSampler
+	if m.profiling {
+		sampler = new(wazeroSampler)
+		ctx = context.WithValue(ctx, samplerKey{}, sampler)
+	}
+
+	var limit *limitedMemory
+	if cfg.MaxMemory > 0 {
+		limit = &limitedMemory{max: uint64(cfg.MaxMemory)}
+		ctx = experimental.WithMemoryAllocator(ctx, limit)
+	}
+
+	// anonymous, so that the module can be instantiated many times, and
+	// without start functions, the guest is started by Run
+	mcfg := wazero.NewModuleConfig().WithName("").WithStartFunctions()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.refs == 0 {
+		cancel()
+		return nil, errors.New("module is closed")
+	}
+
+	mod, err := m.rt.InstantiateModule(ctx, m.compiled, mcfg)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if limit != nil && uint64(len(limit.buf)) > limit.max {
+		size := len(limit.buf)
+		mod.Close(ctx)
+		cancel()
+		return nil, fmt.Errorf("guest needs %d bytes of memory, over the limit of %d", size, limit.max)
+	}
+
+	m.refs++
+	wi := &wazeroInstance{ctx: ctx, cancel: cancel, m: m, mod: mod, limit: limit}
+	for i := 0; i < m.globals; i++ {
+		wi.globals = append(wi.globals, mod.ExportedGlobal(fmt.Sprintf(globalExport, i)))
+	}
+
+	if sampler != nil {
+		return &sampledWazeroInstance{wi, sampler}, nil
+	}
+
+	return wi, nil
+}
+
+func (m *wazeroModule) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refs--
+	if m.refs > 0 {
+		return
+	}
+
+	ctx := context.Background()
+	m.rt.Close(ctx)
+	if m.cache != nil {
+		m.cache.Close(ctx)
+	}
+}
+
+type wazeroInstance struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	interrupted int32
+	m           *wazeroModule
+	mod         api.Module
+	limit       *limitedMemory
+	globals     []api.Global
+}
+
+func (wi *wazeroInstance) Memory() []byte {
+	mem := wi.mod.Memory()
+	buf, _ := mem.Read(0, mem.Size())
+	return buf
+}
+
+func (wi *wazeroInstance) Call(name string, args ...int32) (int32, error) {
+	fn := wi.mod.ExportedFunction(name)
+	if fn == nil {
+		return 0, fmt.Errorf("missing export %s", name)
+	}
+
+	params := make([]uint64, len(args))
+	for i, arg := range args {
+		params[i] = api.EncodeI32(arg)
+	}
+
+	res, err := fn.Call(wi.ctx, params...)
+	if wi.limit != nil && wi.limit.refused {
+		return 0, fmt.Errorf("%s: %w", name, ErrOutOfMemory)
+	}
+
+	if atomic.LoadInt32(&wi.interrupted) == 1 {
+		return 0, fmt.Errorf("%s: %w", name, ErrInterrupted)
+	}
+
+	if err != nil {
+		return 0, wazeroTrap(err)
+	}
+
+	if len(res) == 0 {
+		return 0, nil
+	}
+
+	return api.DecodeI32(res[0]), nil
+}
+
+// wazeroTrap returns a *GuestTrap for the errors of wazero that come with the
+// guest's stack, that is traps. Their reason is the first line.
+func wazeroTrap(err error) error {
+	msg, _, ok := strings.Cut(err.Error(), "\nwasm stack trace:\n")
+	if !ok {
+		return err
+	}
+
+	msg = strings.TrimPrefix(msg, "wasm error: ")
+	msg = strings.TrimSuffix(msg, " (recovered by wazero)")
+	return &GuestTrap{Reason: msg, Err: err}
+}
+
+func (wi *wazeroInstance) Interrupt() {
+	atomic.StoreInt32(&wi.interrupted, 1)
+	wi.cancel()
+}
+
+func (wi *wazeroInstance) Close() {
+	wi.mod.Close(context.Background())
+	wi.cancel()
+	wi.m.Close()
+}
+
+// limitedMemory backs the linear memory of an instance, refusing to grow it
+// past max. The initial size is always allocated, Instantiate checks it.
+type limitedMemory struct {
+	max     uint64
+	buf     []byte
+	refused bool
+}
+
+func (lm *limitedMemory) Allocate(cap, max uint64) experimental.LinearMemory {
+	lm.buf = make([]byte, 0, cap)
+	return lm
+}
+
+func (lm *limitedMemory) Reallocate(size uint64) []byte {
+	if size > lm.max && len(lm.buf) > 0 {
+		lm.refused = true
+		return nil
+	}
+
+	if size <= uint64(cap(lm.buf)) {
+		lm.buf = lm.buf[:size]
+		return lm.buf
+	}
+
+	buf := make([]byte, size)
+	copy(buf, lm.buf)
+	lm.buf = buf
+	return buf
+}
+
+func (lm *limitedMemory) Free() {
+	lm.buf = nil
+}
+
+func (wi *wazeroInstance) Globals() []uint64 {
+	vs := make([]uint64, len(wi.globals))
+	for i, g := range wi.globals {
+		vs[i] = g.Get()
+	}
+
+	return vs
+}
+
+func (wi *wazeroInstance) Restore(memory []byte, globals []uint64) error {
+	if len(globals) != len(wi.globals) {
+		return fmt.Errorf("guest has %d globals, snapshot has %d", len(wi.globals), len(globals))
+	}
+
+	mem := wi.mod.Memory()
+	if size := uint32(len(memory)); mem.Size() < size {
+		if _, ok := mem.Grow((size - mem.Size()) / 65536); !ok {
+			return fmt.Errorf("growing the memory to %d bytes: %w", size, ErrOutOfMemory)
+		}
+	}
+
+	if !mem.Write(0, memory) {
+		return errors.New("restoring the memory: out of range")
+	}
+
+	for i, g := range wi.globals {
+		if mg, ok := g.(api.MutableGlobal); ok {
+			mg.Set(globals[i])
+		}
+	}
+
+	return nil
+}
+
+// globalExport is the name under which exportGlobals exports a global.
+const globalExport = "go-wasm.global%d"
+
+// exportGlobals adds the module's globals to its exports, as globalExport, so
+// that snapshots can read and restore them. It returns the new bytes and the
+// number of globals, or the bytes as they are and 0 if they can't be parsed.
+func exportGlobals(bytes []byte) ([]byte, int) {
+	if len(bytes) < 8 {
+		return bytes, 0
+	}
+
+	globals := 0
+	exports := -1 // offset of the export section
+	for off := 8; off < len(bytes); {
+		size, n := uleb128(bytes[off+1:])
+		start := off + 1 + n
+		if n == 0 || uint64(len(bytes)-start) < size {
+			return bytes, 0
+		}
+
+		body := bytes[start : start+int(size)]
+		switch bytes[off] {
+		case 2:
+			imported, ok := importedGlobals(body)
+			if !ok {
+				return bytes, 0
+			}
+			globals += imported
+		case 6:
+			defined, n := uleb128(body)
+			if n == 0 {
+				return bytes, 0
+			}
+			globals += int(defined)
+		case 7:
+			exports = off
+		}
+
+		off = start + int(size)
+	}
+
+	if exports < 0 || globals == 0 {
+		return bytes, 0
+	}
+
+	size, n := uleb128(bytes[exports+1:])
+	start := exports + 1 + n
+	body := bytes[start : start+int(size)]
+	count, n := uleb128(body)
+	if n == 0 {
+		return bytes, 0
+	}
+
+	newBody := appendUleb128(nil, count+uint64(globals))
+	newBody = append(newBody, body[n:]...)
+	for i := 0; i < globals; i++ {
+		name := fmt.Sprintf(globalExport, i)
+		newBody = appendUleb128(newBody, uint64(len(name)))
+		newBody = append(newBody, name...)
+		newBody = append(newBody, 3)
+		newBody = appendUleb128(newBody, uint64(i))
+	}
+
+	out := append([]byte(nil), bytes[:exports+1]...)
+	out = appendUleb128(out, uint64(len(newBody)))
+	out = append(out, newBody...)
+	out = append(out, bytes[start+int(size):]...)
+	return out, globals
+}
+
+// importedGlobals counts the globals imported by the import section body.
+func importedGlobals(body []byte) (int, bool) {
+	globals := 0
+	ok := forImports(body, func(_, _ string, kind byte) {
+		if kind == 3 {
+			globals++
+		}
+	})
+
+	return globals, ok
+}
+
+// samplerKey is the context key of the sampler of a profiled instance.
+type samplerKey struct{}
+
+type wazeroSampler struct {
+	f atomic.Pointer[func(stack []string)]
+}
+
+type sampledWazeroInstance struct {
+	*wazeroInstance
+	sampler *wazeroSampler
+}
+
+func (si *sampledWazeroInstance) Sample(f func(stack []string)) {
+	if f == nil {
+		si.sampler.f.Store(nil)
+		return
+	}
+
+	si.sampler.f.Store(&f)
+}
+
+// sampleListener takes the samples asked for when the guest calls a function.
+type sampleListener struct{}
+
+func (l sampleListener) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
+	return l
+}
+
+func (sampleListener) Before(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, it experimental.StackIterator) {
+	s, _ := ctx.Value(samplerKey{}).(*wazeroSampler)
+	if s == nil {
+		return
+	}
+
+	f := s.f.Swap(nil)
+	if f == nil {
+		return
+	}
+
+	var stack []string
+	for it.Next() {
+		def := it.Function().Definition()
+		name := def.Name()
+		if name == "" {
+			name = def.DebugName()
+		}
+		stack = append(stack, name)
+	}
+
+	(*f)(stack)
+}
+
+func (sampleListener) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {}
+
+func (sampleListener) Abort(context.Context, api.Module, api.FunctionDefinition, error) {}
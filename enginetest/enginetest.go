@@ -0,0 +1,237 @@
+// Package enginetest implements support for testing implementations of wasm.Engine.
+package enginetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+// Guests are the guests the suite runs, built with GOOS=js GOARCH=wasm by a Go
+// release the engine supports.
+type Guests struct {
+	// Function is examples/function-wasm, which calls back into the host.
+	Function []byte
+
+	// HTTP is examples/http-wasm, whose requests crash it since bridges have no
+	// fetch.
+	HTTP []byte
+}
+
+// Run runs the suite on e, reporting each failure to t. An implementation's
+// test can be as simple as
+//
+//	func TestEngine(t *testing.T) {
+//		enginetest.Run(t, myEngine, guests)
+//	}
+func Run(t *testing.T, e wasm.Engine, g Guests) {
+	t.Helper()
+	tr := &tester{report: func(err string) { t.Error(err) }}
+	tr.testEngine(e, g)
+}
+
+// TestEngine runs the guests on e and checks that bridges behave as they do on
+// the engines shipped with package wasm. It returns an error listing all the
+// failures, see Run for tests.
+func TestEngine(e wasm.Engine, g Guests) error {
+	var errs []string
+	t := &tester{report: func(err string) { errs = append(errs, err) }}
+	t.testEngine(e, g)
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("engine %s:\n\t%s", e.Name(), strings.Join(errs, "\n\t"))
+}
+
+type tester struct {
+	report func(err string)
+}
+
+func (t *tester) errorf(format string, args ...interface{}) {
+	t.report(fmt.Sprintf(format, args...))
+}
+
+func (t *tester) testEngine(e wasm.Engine, g Guests) {
+	if g.Function == nil || g.HTTP == nil {
+		t.errorf("missing guests")
+		return
+	}
+
+	m, err := wasm.NewModule(e, g.Function)
+	if err != nil {
+		t.errorf("compile: %v", err)
+		return
+	}
+
+	// bridges must outlive the module they were created from
+	var bs []*wasm.Bridge
+	for i := 0; i < 2; i++ {
+		b, err := m.NewBridge(fmt.Sprintf("%s-%d", e.Name(), i))
+		if err != nil {
+			t.errorf("instantiate: %v", err)
+			break
+		}
+
+		bs = append(bs, b)
+	}
+	m.Close()
+
+	var running []*wasm.Bridge
+	for _, b := range bs {
+		if t.testRun(b) {
+			running = append(running, b)
+		} else {
+			b.Close()
+		}
+	}
+
+	for _, b := range running {
+		t.testCalls(b)
+	}
+
+	t.testCrash(e, g.HTTP, running)
+
+	// closing one bridge must leave the others alone
+	for i, b := range running {
+		if err := b.Close(); err != nil {
+			t.errorf("%s: close: %v", b.Name(), err)
+		}
+
+		if _, err := b.CallFunc("multiplier", nil); err != wasm.ErrBridgeClosed {
+			t.errorf("%s: call after close: got %v, want %v", b.Name(), err, wasm.ErrBridgeClosed)
+		}
+
+		for _, other := range running[i+1:] {
+			if _, err := other.CallFunc("multiplier", nil); err != nil {
+				t.errorf("%s: call after closing %s: %v", other.Name(), b.Name(), err)
+			}
+		}
+	}
+}
+
+// testRun starts the guest, which calls back into the host before blocking.
+func (t *tester) testRun(b *wasm.Bridge) bool {
+	var args []interface{}
+	var sum interface{}
+	err := b.SetFunc("addProxy", func(a []interface{}) (interface{}, error) {
+		args = a
+		res, err := b.CallFunc("addition", a)
+		sum = res
+		return res, err
+	})
+	if err != nil {
+		t.errorf("%s: set addProxy: %v", b.Name(), err)
+		return false
+	}
+
+	init := make(chan error, 1)
+	go b.Run(context.Background(), init)
+	if err := <-init; err != nil {
+		t.errorf("%s: run: %v", b.Name(), err)
+		return false
+	}
+
+	if !reflect.DeepEqual(args, []interface{}{float64(1), float64(2)}) {
+		t.errorf("%s: addProxy called with %v, want [1 2]", b.Name(), args)
+	}
+
+	if sum != float64(3) {
+		t.errorf("%s: addition(1, 2) = %v, want 3", b.Name(), sum)
+	}
+
+	if b.MemorySize() == 0 {
+		t.errorf("%s: no guest memory", b.Name())
+	}
+
+	return true
+}
+
+func (t *tester) testCalls(b *wasm.Bridge) {
+	res, err := b.CallFunc("multiplier", nil)
+	if err != nil || res != float64(10) {
+		t.errorf("%s: multiplier() = %v, %v, want 10", b.Name(), res, err)
+	}
+
+	res, err = b.CallFunc("getError", nil)
+	if err != nil || res != "test errors" {
+		t.errorf("%s: getError() = %v, %v, want test errors", b.Name(), res, err)
+	}
+
+	res, err = b.CallFunc("getBytes", nil)
+	if err != nil {
+		t.errorf("%s: getBytes(): %v", b.Name(), err)
+		return
+	}
+
+	random, err := wasm.Bytes(res)
+	if err != nil || len(random) != 32 {
+		t.errorf("%s: getBytes() = %v, %v, want 32 bytes", b.Name(), random, err)
+		return
+	}
+
+	if bytes.Equal(random, make([]byte, 32)) {
+		t.errorf("%s: getBytes() returned zeros", b.Name())
+	}
+
+	res, err = b.CallFunc("bytes", []interface{}{wasm.FromBytes(random)})
+	if err != nil {
+		t.errorf("%s: bytes(): %v", b.Name(), err)
+		return
+	}
+
+	echo, err := wasm.Bytes(res)
+	if err != nil || !bytes.Equal(echo, random) {
+		t.errorf("%s: bytes(%v) = %v, %v", b.Name(), random, echo, err)
+	}
+
+	if _, err := b.CallFunc("missing", nil); err == nil || errors.Is(err, wasm.ErrBridgeClosed) {
+		t.errorf("%s: missing() = %v, want missing function", b.Name(), err)
+	}
+}
+
+// testCrash runs the HTTP guest and crashes it with a request, which must not
+// affect the other bridges running.
+func (t *tester) testCrash(e wasm.Engine, guest []byte, others []*wasm.Bridge) {
+	m, err := wasm.NewModule(e, guest)
+	if err != nil {
+		t.errorf("compile the HTTP guest: %v", err)
+		return
+	}
+	defer m.Close()
+
+	b, err := m.NewBridge(e.Name() + "-http")
+	if err != nil {
+		t.errorf("instantiate the HTTP guest: %v", err)
+		return
+	}
+	defer b.Close()
+
+	init := make(chan error, 1)
+	go b.Run(context.Background(), init)
+	if err := <-init; err != nil {
+		t.errorf("%s: run: %v", b.Name(), err)
+		return
+	}
+
+	var trap *wasm.GuestTrap
+	if _, err := b.CallFunc("call", []interface{}{"http://127.0.0.1:1/"}); !errors.As(err, &trap) {
+		t.errorf("%s: call() without fetch: got %v, want a *GuestTrap", b.Name(), err)
+	}
+
+	if _, err := b.CallFunc("call", []interface{}{"http://127.0.0.1:1/"}); err != wasm.ErrBridgeClosed {
+		t.errorf("%s: call after a crash: got %v, want %v", b.Name(), err, wasm.ErrBridgeClosed)
+	}
+
+	for _, other := range others {
+		if _, err := other.CallFunc("multiplier", nil); err != nil {
+			t.errorf("%s: call after %s crashed: %v", other.Name(), b.Name(), err)
+		}
+	}
+}
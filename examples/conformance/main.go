@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/vedhavyas/go-wasm"
+	"github.com/vedhavyas/go-wasm/enginetest"
+)
+
+// Runs the conformance suite against every engine in this build.
+// CGO_ENABLED=0 leaves out wasmer. examples/http-wasm must be built first:
+//
+//	GOOS=js GOARCH=wasm go build -o examples/http-wasm/main.wasm ./examples/http-wasm
+func main() {
+	var g enginetest.Guests
+	var err error
+	if g.Function, err = os.ReadFile("./examples/function-wasm/main.wasm"); err != nil {
+		panic(err)
+	}
+	if g.HTTP, err = os.ReadFile("./examples/http-wasm/main.wasm"); err != nil {
+		panic(err)
+	}
+
+	failed := false
+	for _, e := range wasm.Engines() {
+		if err := enginetest.TestEngine(e, g); err != nil {
+			log.Println(err)
+			failed = true
+			continue
+		}
+
+		log.Printf("engine %s: ok\n", e.Name())
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
 
 	"github.com/vedhavyas/go-wasm"
 )
@@ -24,7 +25,7 @@ func multiply(b *wasm.Bridge, a int) (int, error) {
 }
 
 func main() {
-	b, err := wasm.BridgeFromFile("test", "./examples/function-wasm/main.wasm", nil)
+	b, err := wasm.BridgeFromFile("test", "./examples/function-wasm/main.wasm", wasm.WithLogger(slog.Default()))
 	if err != nil {
 		panic(err)
 	}
@@ -3,12 +3,13 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
 
 	"github.com/vedhavyas/go-wasm"
 )
 
 func main() {
-	b, err := wasm.BridgeFromFile("test", "./examples/http-wasm/main.wasm", nil)
+	b, err := wasm.BridgeFromFile("test", "./examples/http-wasm/main.wasm", wasm.WithLogger(slog.Default()))
 	if err != nil {
 		panic(err)
 	}
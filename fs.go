@@ -0,0 +1,542 @@
+package wasm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// WithDir mounts the host directory dir, as WithMount does, and makes it the
+// guest's working directory.
+func WithDir(dir string) Option {
+	return func(b *Bridge) {
+		WithMount(dir)(b)
+		b.files.cwd = b.files.mounts[len(b.files.mounts)-1]
+	}
+}
+
+// WithMount gives the guest access to the host directory dir and everything
+// in it, at the same path. The guest sees no other files than the mounted ones
+// and its stdio. Symbolic links in mounted directories are followed, even out
+// of them: mounts keep the guest from stumbling on the host's files, they
+// don't sandbox it.
+func WithMount(dir string) Option {
+	return func(b *Bridge) {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		b.files.mounts = append(b.files.mounts, dir)
+	}
+}
+
+// fileSystem is the guest's view of the host's files: the mounted
+// directories and the files it opened in them.
+type fileSystem struct {
+	mounts []string
+	cwd    string
+	fds    map[int]*os.File
+	nextFD int
+}
+
+// path returns the host path of the guest's path p, if it is mounted.
+func (fs *fileSystem) path(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(fs.cwd, p)
+	}
+
+	p = filepath.Clean(p)
+	for _, m := range fs.mounts {
+		if p == m || strings.HasPrefix(p, m+string(filepath.Separator)) || m == string(filepath.Separator) {
+			return p, nil
+		}
+	}
+
+	return "", syscall.ENOENT
+}
+
+func (fs *fileSystem) file(fd int) (*os.File, error) {
+	f, ok := fs.fds[fd]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	return f, nil
+}
+
+func (fs *fileSystem) chdir(dir string) error {
+	p, err := fs.path(dir)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return syscall.ENOTDIR
+	}
+
+	fs.cwd = p
+	return nil
+}
+
+func (fs *fileSystem) open(path string, flags int, perm os.FileMode) (interface{}, error) {
+	p, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(p, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.fds == nil {
+		fs.fds = make(map[int]*os.File)
+		fs.nextFD = 3
+	}
+
+	fd := fs.nextFD
+	fs.nextFD++
+	fs.fds[fd] = f
+	return fd, nil
+}
+
+func (fs *fileSystem) close(fd int) error {
+	f, err := fs.file(fd)
+	if err != nil {
+		return err
+	}
+
+	delete(fs.fds, fd)
+	return f.Close()
+}
+
+func (fs *fileSystem) closeAll() {
+	for fd, f := range fs.fds {
+		f.Close()
+		delete(fs.fds, fd)
+	}
+}
+
+func (fs *fileSystem) read(fd int, p []byte, pos interface{}) (int, error) {
+	f, err := fs.file(fd)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	if pos != nil {
+		n, err = f.ReadAt(p, int64(toFloat(pos)))
+	} else {
+		n, err = f.Read(p)
+	}
+
+	// Node.js reads nothing at the end of the file
+	if err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (fs *fileSystem) write(fd int, p []byte, pos interface{}) (int, error) {
+	f, err := fs.file(fd)
+	if err != nil {
+		return 0, err
+	}
+
+	if pos != nil {
+		return f.WriteAt(p, int64(toFloat(pos)))
+	}
+
+	return f.Write(p)
+}
+
+// stat returns the stats of the file at path, following symbolic links or not.
+func (fs *fileSystem) stat(path string, follow bool) (interface{}, error) {
+	p, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stat := os.Lstat
+	if follow {
+		stat = os.Stat
+	}
+
+	fi, err := stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return statObject(fi), nil
+}
+
+func (fs *fileSystem) readdir(path string) (interface{}, error) {
+	p, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]interface{}, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+
+	return &names, nil
+}
+
+// statObject returns fi as the fs.Stats of Node.js. Only the modification
+// time is known on every platform, it stands for the access and change times.
+func statObject(fi os.FileInfo) *object {
+	st := sysStat(fi)
+	isDir := fi.IsDir()
+	mtime := float64(fi.ModTime().UnixNano()) / float64(time.Millisecond)
+	return propObject("Stats", map[string]interface{}{
+		"dev":     st.dev,
+		"ino":     st.ino,
+		"mode":    st.mode,
+		"nlink":   st.nlink,
+		"uid":     st.uid,
+		"gid":     st.gid,
+		"rdev":    st.rdev,
+		"size":    float64(fi.Size()),
+		"blksize": st.blksize,
+		"blocks":  st.blocks,
+		"atimeMs": mtime,
+		"mtimeMs": mtime,
+		"ctimeMs": mtime,
+		"isDirectory": Func(func(args []interface{}) (interface{}, error) {
+			return isDir, nil
+		}),
+	})
+}
+
+// fileStat are the stats of a file that depend on the platform, see sysStat.
+type fileStat struct {
+	dev, ino, mode, nlink, uid, gid, rdev, blksize, blocks float64
+}
+
+// modeStat returns the stats of fi that every platform has: its mode, in the
+// bits of Node.js, which are those of Unix.
+func modeStat(fi os.FileInfo) fileStat {
+	m := fi.Mode()
+	mode := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= 0o040000
+	case m&os.ModeSymlink != 0:
+		mode |= 0o120000
+	case m&os.ModeNamedPipe != 0:
+		mode |= 0o010000
+	case m&os.ModeSocket != 0:
+		mode |= 0o140000
+	case m&os.ModeCharDevice != 0:
+		mode |= 0o020000
+	case m&os.ModeDevice != 0:
+		mode |= 0o060000
+	default:
+		mode |= 0o100000
+	}
+
+	if m&os.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+
+	return fileStat{mode: float64(mode), nlink: 1}
+}
+
+// fsObject returns the fs object of the guest. Its functions call their
+// callback, the last of their arguments, before returning.
+func (b *Bridge) fsObject(goObj *object) *object {
+	fs := &b.files
+	call := func(fn func(args []interface{}) (interface{}, error)) Func {
+		return func(args []interface{}) (interface{}, error) {
+			callback := args[len(args)-1].(*funcWrapper)
+			res, err := fn(args[:len(args)-1])
+			var jsErr interface{}
+			if err != nil {
+				jsErr, res = (&jsError{err: err}).object(), nil
+			}
+
+			return b.makeFuncWrapper(callback.id, goObj, &[]interface{}{jsErr, res})
+		}
+	}
+
+	// onPath and onFD are for the functions of a single path or fd, and
+	// no result
+	onPath := func(fn func(p string, args []interface{}) error) Func {
+		return call(func(args []interface{}) (interface{}, error) {
+			p, err := fs.path(args[0].(string))
+			if err != nil {
+				return nil, err
+			}
+			return nil, fn(p, args[1:])
+		})
+	}
+	onFD := func(fn func(f *os.File, args []interface{}) error) Func {
+		return call(func(args []interface{}) (interface{}, error) {
+			f, err := fs.file(int(toFloat(args[0])))
+			if err != nil {
+				return nil, err
+			}
+			return nil, fn(f, args[1:])
+		})
+	}
+	onPaths := func(fn func(from, to string) error) Func {
+		return call(func(args []interface{}) (interface{}, error) {
+			from, err := fs.path(args[0].(string))
+			if err != nil {
+				return nil, err
+			}
+			to, err := fs.path(args[1].(string))
+			if err != nil {
+				return nil, err
+			}
+			return nil, fn(from, to)
+		})
+	}
+	num := func(v interface{}) int {
+		return int(toFloat(v))
+	}
+	seconds := func(v interface{}) time.Time {
+		return time.Unix(0, int64(toFloat(v)*float64(time.Second)))
+	}
+
+	return propObject("fs", map[string]interface{}{
+		"constants": propObject("constants", map[string]interface{}{
+			"O_RDONLY": syscall.O_RDONLY,
+			"O_WRONLY": syscall.O_WRONLY,
+			"O_RDWR":   syscall.O_RDWR,
+			"O_CREAT":  syscall.O_CREAT,
+			"O_TRUNC":  syscall.O_TRUNC,
+			"O_APPEND": syscall.O_APPEND,
+			"O_EXCL":   syscall.O_EXCL,
+		}),
+
+		"write": call(func(args []interface{}) (interface{}, error) {
+			fd := num(args[0])
+			buf, err := bufferArg(args[1:4])
+			if err != nil {
+				return nil, err
+			}
+			if fd == 1 || fd == 2 {
+				return b.writeStdout(fd, buf)
+			}
+
+			return fs.write(fd, buf, args[4])
+		}),
+		"read": call(func(args []interface{}) (interface{}, error) {
+			fd := num(args[0])
+			buf, err := bufferArg(args[1:4])
+			if err != nil {
+				return nil, err
+			}
+			if fd != 0 {
+				return fs.read(fd, buf, args[4])
+			}
+
+			if b.stdin == nil {
+				return 0, nil
+			}
+			n, err := b.stdin.Read(buf)
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}),
+		"open": call(func(args []interface{}) (interface{}, error) {
+			return fs.open(args[0].(string), num(args[1]), os.FileMode(num(args[2])))
+		}),
+		"close": call(func(args []interface{}) (interface{}, error) {
+			return nil, fs.close(num(args[0]))
+		}),
+		"stat": call(func(args []interface{}) (interface{}, error) {
+			return fs.stat(args[0].(string), true)
+		}),
+		"lstat": call(func(args []interface{}) (interface{}, error) {
+			return fs.stat(args[0].(string), false)
+		}),
+		"fstat": call(func(args []interface{}) (interface{}, error) {
+			f, err := fs.file(num(args[0]))
+			if err != nil {
+				return nil, err
+			}
+
+			fi, err := f.Stat()
+			if err != nil {
+				return nil, err
+			}
+			return statObject(fi), nil
+		}),
+		"readdir": call(func(args []interface{}) (interface{}, error) {
+			return fs.readdir(args[0].(string))
+		}),
+		"readlink": call(func(args []interface{}) (interface{}, error) {
+			p, err := fs.path(args[0].(string))
+			if err != nil {
+				return nil, err
+			}
+			return os.Readlink(p)
+		}),
+		"mkdir": onPath(func(p string, args []interface{}) error {
+			return os.Mkdir(p, os.FileMode(num(args[0])))
+		}),
+		"unlink": onPath(func(p string, args []interface{}) error {
+			return syscall.Unlink(p)
+		}),
+		"rmdir": onPath(func(p string, args []interface{}) error {
+			return syscall.Rmdir(p)
+		}),
+		"chmod": onPath(func(p string, args []interface{}) error {
+			return os.Chmod(p, os.FileMode(num(args[0])))
+		}),
+		"chown": onPath(func(p string, args []interface{}) error {
+			return os.Chown(p, num(args[0]), num(args[1]))
+		}),
+		"lchown": onPath(func(p string, args []interface{}) error {
+			return os.Lchown(p, num(args[0]), num(args[1]))
+		}),
+		"utimes": onPath(func(p string, args []interface{}) error {
+			return os.Chtimes(p, seconds(args[0]), seconds(args[1]))
+		}),
+		"truncate": onPath(func(p string, args []interface{}) error {
+			return os.Truncate(p, int64(num(args[0])))
+		}),
+		"symlink": call(func(args []interface{}) (interface{}, error) {
+			p, err := fs.path(args[1].(string))
+			if err != nil {
+				return nil, err
+			}
+			return nil, os.Symlink(args[0].(string), p)
+		}),
+		"rename": onPaths(os.Rename),
+		"link":   onPaths(os.Link),
+		"fchmod": onFD(func(f *os.File, args []interface{}) error {
+			return f.Chmod(os.FileMode(num(args[0])))
+		}),
+		"fchown": onFD(func(f *os.File, args []interface{}) error {
+			return f.Chown(num(args[0]), num(args[1]))
+		}),
+		"ftruncate": onFD(func(f *os.File, args []interface{}) error {
+			return f.Truncate(int64(num(args[0])))
+		}),
+		"fsync": onFD(func(f *os.File, args []interface{}) error {
+			return f.Sync()
+		}),
+	})
+}
+
+// pathObject returns the path object of the guest, Node's path module as far
+// as Go 1.21 and later use it.
+func (b *Bridge) pathObject() *object {
+	return propObject("path", map[string]interface{}{
+		"resolve": Func(func(args []interface{}) (interface{}, error) {
+			p := b.files.cwd
+			for _, arg := range args {
+				s, ok := arg.(string)
+				if !ok {
+					return nil, fmt.Errorf("path.resolve: expected string, got %T", arg)
+				}
+
+				if filepath.IsAbs(s) {
+					p = s
+				} else {
+					p = filepath.Join(p, s)
+				}
+			}
+
+			return filepath.Clean(p), nil
+		}),
+	})
+}
+
+// bufferArg returns the bytes of args, a buffer, an offset and a length as
+// given to fs.read and fs.write.
+func bufferArg(args []interface{}) ([]byte, error) {
+	data, ok := byteView(args[0])
+	offset, length := int(toFloat(args[1])), int(toFloat(args[2]))
+	if !ok || offset < 0 || length < 0 || offset+length > len(data) {
+		return nil, fmt.Errorf("invalid buffer: %w", syscall.EINVAL)
+	}
+
+	return data[offset : offset+length], nil
+}
+
+// jsError is an error thrown at the guest, or given to its callbacks, as the
+// system errors of Node.js: the guest's syscall package maps their code back
+// to its errno.
+type jsError struct {
+	err error
+}
+
+func (e *jsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *jsError) Unwrap() error {
+	return e.err
+}
+
+func (e *jsError) object() *object {
+	code := "EIO"
+	var errno syscall.Errno
+	if errors.As(e.err, &errno) {
+		if c, ok := errnoCodes[errno]; ok {
+			code = c
+		}
+	}
+
+	return propObject("Error", map[string]interface{}{
+		"code":    code,
+		"message": e.err.Error(),
+	})
+}
+
+// errnoCodes are the codes of the errnos the host's file system returns.
+var errnoCodes = map[syscall.Errno]string{
+	syscall.EPERM:        "EPERM",
+	syscall.ENOENT:       "ENOENT",
+	syscall.EIO:          "EIO",
+	syscall.ENXIO:        "ENXIO",
+	syscall.EBADF:        "EBADF",
+	syscall.EAGAIN:       "EAGAIN",
+	syscall.EACCES:       "EACCES",
+	syscall.EBUSY:        "EBUSY",
+	syscall.EEXIST:       "EEXIST",
+	syscall.EXDEV:        "EXDEV",
+	syscall.ENOTDIR:      "ENOTDIR",
+	syscall.EISDIR:       "EISDIR",
+	syscall.EINVAL:       "EINVAL",
+	syscall.EMFILE:       "EMFILE",
+	syscall.ETXTBSY:      "ETXTBSY",
+	syscall.EFBIG:        "EFBIG",
+	syscall.ENOSPC:       "ENOSPC",
+	syscall.ESPIPE:       "ESPIPE",
+	syscall.EROFS:        "EROFS",
+	syscall.EMLINK:       "EMLINK",
+	syscall.EPIPE:        "EPIPE",
+	syscall.ENAMETOOLONG: "ENAMETOOLONG",
+	syscall.ENOSYS:       "ENOSYS",
+	syscall.ENOTEMPTY:    "ENOTEMPTY",
+	syscall.ELOOP:        "ELOOP",
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+// +build !unix
+
+package wasm
+
+import (
+	"os"
+)
+
+// sysStat returns the stats of fi kept by the system. Beyond Unix, only its
+// mode is known.
+func sysStat(fi os.FileInfo) fileStat {
+	return modeStat(fi)
+}
@@ -0,0 +1,76 @@
+package wasm_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	b := startGuest(t, nil, wasm.WithDir(dir))
+	file := func(args ...interface{}) interface{} {
+		t.Helper()
+		res, err := b.CallFunc("file", args)
+		if err != nil {
+			t.Fatalf("file%v: %v", args, err)
+		}
+		return res
+	}
+
+	// the errnos of GOOS=js, those of Linux
+	const enoent, einval = float64(2), float64(22)
+	tests := []struct {
+		args []interface{}
+		want interface{}
+	}{
+		{[]interface{}{"write", "a.txt", "hello"}, nil},
+		{[]interface{}{"read", "a.txt"}, "hello"},
+		{[]interface{}{"append", "a.txt", ", world"}, nil},
+		{[]interface{}{"read", filepath.Join(dir, "a.txt")}, "hello, world"},
+		{[]interface{}{"readAt", "a.txt", 7, 5}, "world"},
+		{[]interface{}{"readAt", "a.txt", 10, 5}, "ld"},
+		{[]interface{}{"rename", "a.txt", "b.txt"}, nil},
+		{[]interface{}{"read", "a.txt"}, enoent},
+		{[]interface{}{"read", "b.txt"}, "hello, world"},
+
+		// errors of the host's file system
+		{[]interface{}{"truncate", "b.txt", -1}, einval},
+		{[]interface{}{"append", "c.txt", "no file"}, enoent},
+
+		// paths out of the mounts don't exist
+		{[]interface{}{"write", filepath.Join(filepath.Dir(dir), "out.txt"), "out"}, enoent},
+		{[]interface{}{"rename", "b.txt", filepath.Join(filepath.Dir(dir), "out.txt")}, enoent},
+	}
+
+	for _, test := range tests {
+		if got := file(test.args...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("file%v = %v, want %v", test.args, got, test.want)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "b.txt"))
+	if err != nil || string(data) != "hello, world" {
+		t.Errorf("got b.txt %q, %v on the host, want %q", data, err, "hello, world")
+	}
+	// the guest's view of the files is the host's
+	for _, name := range []string{"b.txt", "."} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := fmt.Sprintf("%d %s", fi.Size(), fi.Mode())
+		if got := file("stat", name); got != want {
+			t.Errorf("got stat %v of %s, want %v", got, name, want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "out.txt")); !os.IsNotExist(err) {
+		t.Errorf("the guest wrote out of its mount: %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build unix
+// +build unix
+
+package wasm
+
+import (
+	"os"
+	"syscall"
+)
+
+// sysStat returns the stats of fi kept by the system.
+func sysStat(fi os.FileInfo) fileStat {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return modeStat(fi)
+	}
+
+	return fileStat{
+		dev:     float64(st.Dev),
+		ino:     float64(st.Ino),
+		mode:    float64(st.Mode),
+		nlink:   float64(st.Nlink),
+		uid:     float64(st.Uid),
+		gid:     float64(st.Gid),
+		rdev:    float64(st.Rdev),
+		blksize: float64(st.Blksize),
+		blocks:  float64(st.Blocks),
+	}
+}
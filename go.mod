@@ -1,5 +1,8 @@
 module github.com/vedhavyas/go-wasm
 
-go 1.14
+go 1.21
 
-require github.com/wasmerio/go-ext-wasm v0.3.1
+require (
+	github.com/tetratelabs/wazero v1.8.2
+	github.com/wasmerio/go-ext-wasm v0.3.1
+)
@@ -0,0 +1,208 @@
+package wasm
+
+// GuestStats is what the host can tell about a guest from the outside.
+//
+// The Go runtime's heap and goroutines can't be inspected this way: Go's wasm
+// linker names the guest's functions but not its variables, so memstats and
+// allgs can't be found in linear memory without the guest's help. The wasm
+// globals, like the g of the running goroutine, aren't exported, and would
+// only lead to the heap through the runtime's private structures, whose
+// layout changes with each Go release. The stack of a goroutine calling the
+// host is known: it is read for the frames of a GuestTrap.
+type GuestStats struct {
+	GoVersion  string // Go version the guest was built with, empty if unknown
+	MemorySize int    // size of the linear memory in bytes
+	Values     int    // values held by the host for the guest
+	Timers     int    // timers the guest is waiting on
+}
+
+// GuestStats returns the stats of the guest. It can be called from any
+// goroutine, including while the guest runs.
+func (b *Bridge) GuestStats() (GuestStats, error) {
+	if err := b.check(); err != nil {
+		return GuestStats{}, err
+	}
+
+	s := GuestStats{GoVersion: b.goVersion, MemorySize: b.MemorySize()}
+	b.valuesMu.RLock()
+	s.Values = len(b.valueMap)
+	b.valuesMu.RUnlock()
+	b.timersMu.Lock()
+	s.Timers = len(b.timers)
+	b.timersMu.Unlock()
+	return s, nil
+}
+
+// goVersion returns the Go version recorded by the Go linker in the go.version
+// section of the wasm bytes, or "" if there is none.
+func goVersion(bytes []byte) string {
+	return string(customSection(bytes, "go.version"))
+}
+
+// modernABI reports whether the wasm bytes import the syscall/js ABI of Go
+// 1.14 and later, whose guests release the values they no longer hold with
+// finalizeRef. Go 1.13 imports runtime.nanotime, later versions nanotime1.
+func modernABI(bytes []byte) bool {
+	modern := false
+	forImports(section(bytes, 2), func(_, name string, kind byte) {
+		if kind == 0 && name == "runtime.nanotime1" {
+			modern = true
+		}
+	})
+
+	return modern
+}
+
+// section returns the body of the first section id of the wasm bytes, or nil
+// if there is none or the bytes are malformed.
+func section(bytes []byte, id byte) []byte {
+	if len(bytes) < 8 {
+		return nil
+	}
+
+	for rest := bytes[8:]; len(rest) > 0; {
+		size, n := uleb128(rest[1:])
+		if n == 0 || uint64(len(rest)-1-n) < size {
+			return nil
+		}
+
+		if rest[0] == id {
+			return rest[1+n : 1+n+int(size)]
+		}
+		rest = rest[1+n+int(size):]
+	}
+
+	return nil
+}
+
+// forImports calls f with the module, name and kind of each import of the
+// import section body, and reports whether the body is well formed.
+func forImports(body []byte, f func(module, name string, kind byte)) bool {
+	count, n := uleb128(body)
+	if n == 0 {
+		return false
+	}
+
+	p := body[n:]
+	// skip reads a LEB128 number
+	skip := func() bool {
+		_, n := uleb128(p)
+		p = p[n:]
+		return n > 0
+	}
+	name := func() (string, bool) {
+		l, n := uleb128(p)
+		if n == 0 || uint64(len(p)-n) < l {
+			return "", false
+		}
+		s := string(p[n : n+int(l)])
+		p = p[n+int(l):]
+		return s, true
+	}
+
+	for i := uint64(0); i < count; i++ {
+		module, ok := name()
+		if !ok {
+			return false
+		}
+		field, ok := name()
+		if !ok || len(p) == 0 {
+			return false
+		}
+
+		kind := p[0]
+		p = p[1:]
+		switch kind {
+		case 0: // function
+			if !skip() {
+				return false
+			}
+		case 1, 2: // table, memory
+			if kind == 1 {
+				if len(p) == 0 {
+					return false
+				}
+				p = p[1:]
+			}
+			if len(p) == 0 {
+				return false
+			}
+			flags := p[0]
+			p = p[1:]
+			if !skip() || (flags&1 != 0 && !skip()) {
+				return false
+			}
+		case 3: // global
+			if len(p) < 2 {
+				return false
+			}
+			p = p[2:]
+		default:
+			return false
+		}
+
+		f(module, field, kind)
+	}
+
+	return true
+}
+
+// customSection returns the contents of the custom section name of the wasm
+// bytes, or nil if there is none or the bytes are malformed.
+func customSection(bytes []byte, name string) []byte {
+	if len(bytes) < 8 {
+		return nil
+	}
+
+	for rest := bytes[8:]; len(rest) > 0; {
+		id := rest[0]
+		size, n := uleb128(rest[1:])
+		if n == 0 || uint64(len(rest)-1-n) < size {
+			return nil
+		}
+
+		body := rest[1+n : 1+n+int(size)]
+		rest = rest[1+n+int(size):]
+		if id != 0 {
+			continue
+		}
+
+		l, n := uleb128(body)
+		if n == 0 || uint64(len(body)-n) < l {
+			return nil
+		}
+
+		if string(body[n:n+int(l)]) == name {
+			return body[n+int(l):]
+		}
+	}
+
+	return nil
+}
+
+// uleb128 decodes an unsigned LEB128 number from p and returns it with its
+// size, which is 0 if p doesn't start with one.
+func uleb128(p []byte) (uint64, int) {
+	var v uint64
+	for i, c := range p {
+		if i == 10 {
+			return 0, 0
+		}
+
+		v |= uint64(c&0x7f) << (7 * uint(i))
+		if c < 0x80 {
+			return v, i + 1
+		}
+	}
+
+	return 0, 0
+}
+
+func appendUleb128(p []byte, v uint64) []byte {
+	for v >= 0x80 {
+		p = append(p, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(p, byte(v))
+}
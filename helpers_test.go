@@ -0,0 +1,241 @@
+package wasm_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+// functionWasm is examples/function-wasm built with Go 1.13. It registers
+// addition, multiplier, getBytes, getError and bytes, and calls addProxy from
+// its main.
+const functionWasm = "examples/function-wasm/main.wasm"
+
+var (
+	modulesMu sync.Mutex
+	modules   = map[string]*wasm.Module{}
+)
+
+// functionModule returns functionWasm compiled on e, once per test binary.
+func functionModule(t testing.TB, e wasm.Engine) *wasm.Module {
+	t.Helper()
+	modulesMu.Lock()
+	defer modulesMu.Unlock()
+	if m, ok := modules[e.Name()]; ok {
+		return m
+	}
+
+	bytes, err := os.ReadFile(functionWasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := wasm.NewModule(e, bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modules[e.Name()] = m
+	return m
+}
+
+// legacyGo is the oldest Go release whose guests the bridge runs.
+const legacyGo = "go1.13.15"
+
+var (
+	guestsMu  sync.Mutex
+	guestsDir string
+	guests    = map[string][]byte{}
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if guestsDir != "" {
+		os.RemoveAll(guestsDir)
+	}
+	os.Exit(code)
+}
+
+// buildGuest returns the package in dir built with GOOS=js by the Go release
+// version, or by the go command running the tests if it is empty, once per
+// test binary. The go command fetches version if needed, the test is skipped
+// if it can't or if there is no go command.
+func buildGuest(t testing.TB, dir, version string) []byte {
+	t.Helper()
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to build the guest")
+	}
+
+	guestsMu.Lock()
+	defer guestsMu.Unlock()
+	key := dir + "@" + version
+	if bytes, ok := guests[key]; ok {
+		return bytes
+	}
+
+	env := os.Environ()
+	if version != "" {
+		env = append(env, "GOTOOLCHAIN="+version, "GOFLAGS=")
+		cmd := exec.Command(goCmd, "version")
+		cmd.Env = env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Skipf("no %s to build the guest: %v\n%s", version, err, out)
+		}
+	}
+
+	if guestsDir == "" {
+		if guestsDir, err = os.MkdirTemp("", "go-wasm-test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(guestsDir, strconv.Itoa(len(guests))+".wasm")
+	cmd := exec.Command(goCmd, "build", "-o", out, ".")
+	cmd.Dir = dir
+	cmd.Env = append(env, "GOOS=js", "GOARCH=wasm")
+	if log, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building %s: %v\n%s", dir, err, log)
+	}
+
+	bytes, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guests[key] = bytes
+	return bytes
+}
+
+// modernFunctionWasm returns examples/function-wasm built with the go command
+// running the tests.
+func modernFunctionWasm(t testing.TB) []byte {
+	t.Helper()
+	return buildGuest(t, "examples/function-wasm", "")
+}
+
+// startGuest runs a new bridge of testdata/guest on wazero, once set up by
+// setup if not nil. The bridge is closed when the test ends.
+func startGuest(t testing.TB, setup func(b *wasm.Bridge), opts ...wasm.Option) *wasm.Bridge {
+	t.Helper()
+	b := newBridge(t, guestModule(t), opts...)
+	if setup != nil {
+		setup(b)
+	}
+	if err := run(t, b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// guestModule returns testdata/guest built with the go command running the
+// tests and compiled on wazero, once per test binary.
+func guestModule(t testing.TB) *wasm.Module {
+	t.Helper()
+	bytes := buildGuest(t, "testdata/guest", "")
+	modulesMu.Lock()
+	defer modulesMu.Unlock()
+	if m, ok := modules["guest"]; ok {
+		return m
+	}
+
+	m, err := wasm.NewModule(wasm.WazeroEngine(), bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modules["guest"] = m
+	return m
+}
+
+// modernFunctionModule returns modernFunctionWasm compiled on wazero.
+func modernFunctionModule(t testing.TB) *wasm.Module {
+	t.Helper()
+	m, err := wasm.NewModule(wasm.WazeroEngine(), modernFunctionWasm(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(m.Close)
+	return m
+}
+
+// startFunction runs a new bridge of functionWasm on e, whose addProxy calls
+// back addition. The bridge is closed when the test ends.
+func startFunction(t testing.TB, e wasm.Engine, opts ...wasm.Option) *wasm.Bridge {
+	t.Helper()
+	return startBridge(t, functionModule(t, e), opts...)
+}
+
+// startBridge is startFunction for a module of examples/function-wasm.
+func startBridge(t testing.TB, m *wasm.Module, opts ...wasm.Option) *wasm.Bridge {
+	t.Helper()
+	b := newBridge(t, m, opts...)
+	err := b.SetFunc("addProxy", func(args []interface{}) (interface{}, error) {
+		return b.CallFunc("addition", args)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(t, b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// newFunction instantiates functionWasm on e, with its output discarded unless
+// opts say otherwise. The bridge is closed when the test ends.
+func newFunction(t testing.TB, e wasm.Engine, opts ...wasm.Option) *wasm.Bridge {
+	t.Helper()
+	return newBridge(t, functionModule(t, e), opts...)
+}
+
+// newBridge is newFunction for any module.
+func newBridge(t testing.TB, m *wasm.Module, opts ...wasm.Option) *wasm.Bridge {
+	t.Helper()
+	opts = append([]wasm.Option{wasm.WithStdio(nil, io.Discard, io.Discard)}, opts...)
+	b, err := m.NewBridge("", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// run runs b until the test ends and returns the error of its start.
+func run(t testing.TB, b *wasm.Bridge) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	init := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx, init)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return <-init
+}
+
+// forEngines runs test for each engine of the build.
+func forEngines(t *testing.T, test func(t *testing.T, e wasm.Engine)) {
+	for _, e := range wasm.Engines() {
+		e := e
+		t.Run(e.Name(), func(t *testing.T) {
+			test(t, e)
+		})
+	}
+}
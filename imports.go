@@ -1,145 +1,139 @@
 package wasm
 
-/*
-#include <stdlib.h>
-
-extern void debug(void *context, int32_t a);
-extern void wexit(void *context, int32_t a);
-extern void wwrite(void *context, int32_t a);
-extern void nanotime(void *context, int32_t a);
-extern void walltime(void *context, int32_t a);
-extern void scheduleCallback(void *context, int32_t a);
-extern void clearScheduledCallback(void *context, int32_t a);
-extern void getRandomData(void *context, int32_t a);
-extern void stringVal(void *context, int32_t a);
-extern void valueGet(void *context, int32_t a);
-extern void valueSet(void *context, int32_t a);
-extern void valueIndex(void *context, int32_t a);
-extern void valueSetIndex(void *context, int32_t a);
-extern void valueCall(void *context, int32_t a);
-extern void valueInvoke(void *context, int32_t a);
-extern void valueNew(void *context, int32_t a);
-extern void valueLength(void *context, int32_t a);
-extern void valuePrepareString(void *context, int32_t a);
-extern void valueLoadString(void *context, int32_t a);
-extern void scheduleTimeoutEvent(void *context, int32_t a);
-extern void clearTimeoutEvent(void *context, int32_t a);
-extern void copyBytesToGo (void *context, int32_t a);
-extern void copyBytesToJS (void *context, int32_t a);
-*/
-import "C"
 import (
-	"crypto/rand"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"reflect"
-	"syscall"
+	rdebug "runtime/debug"
 	"time"
-	"unsafe"
-
-	"github.com/wasmerio/go-ext-wasm/wasmer"
 )
 
-//export debug
-func debug(_ unsafe.Pointer, sp int32) {
-	log.Println(sp)
+func (b *Bridge) debug(sp int32) {
+	b.logger.Debug("debug", "sp", sp)
 }
 
-//export wexit
-func wexit(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
-	b.exitCode = int(b.getUint32(sp + 8))
-	b.cancF()
+func (b *Bridge) wexit(sp int32) {
+	code := int(b.getUint32(sp + 8))
+	if code != 0 {
+		b.trap = b.panicTrap()
+	}
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+	b.exitCode = code
+	b.exited = true
+	if b.cancF != nil {
+		b.cancF()
+	}
 }
 
-//export wwrite
-func wwrite(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
+func (b *Bridge) wwrite(sp int32) {
 	fd := int(b.getInt64(sp + 8))
 	p := int(b.getInt64(sp + 16))
 	l := int(b.getInt32(sp + 24))
-	_, err := syscall.Write(fd, b.mem()[p:p+l])
+	_, err := b.writeStdout(fd, b.mem()[p:p+l])
 	if err != nil {
 		panic(fmt.Errorf("wasm-write: %v", err))
 	}
 }
 
-//export nanotime
-func nanotime(ctx unsafe.Pointer, sp int32) {
-	n := time.Now().UnixNano()
-	getBridge(ctx).setInt64(sp+8, n)
+func (b *Bridge) nanotime(sp int32) {
+	n := b.clock.Now().UnixNano()
+	b.setInt64(sp+8, n)
 }
 
-//export walltime
-func walltime(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
-	t := time.Now().UnixNano()
+func (b *Bridge) walltime(sp int32) {
+	t := b.clock.Now().UnixNano()
 	nanos := t % int64(time.Second)
 	b.setInt64(sp+8, t/int64(time.Second))
 	b.setInt32(sp+16, int32(nanos))
 
 }
 
-//export scheduleCallback
-func scheduleCallback(_ unsafe.Pointer, _ int32) {
+func (b *Bridge) scheduleCallback(sp int32) {
 	panic("schedule callback")
 }
 
-//export clearScheduledCallback
-func clearScheduledCallback(_ unsafe.Pointer, _ int32) {
+func (b *Bridge) clearScheduledCallback(sp int32) {
 	panic("clear scheduled callback")
 }
 
-//export getRandomData
-func getRandomData(ctx unsafe.Pointer, sp int32) {
-	s := getBridge(ctx).loadSlice(sp + 8)
-	_, err := rand.Read(s)
+func (b *Bridge) getRandomData(sp int32) {
+	s := b.loadSlice(sp + 8)
+	_, err := io.ReadFull(b.random, s)
 	if err != nil {
 		panic("failed: getRandomData")
 	}
+	b.wroteSlice(sp + 8)
 }
 
-//export stringVal
-func stringVal(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
+func (b *Bridge) stringVal(sp int32) {
 	str := b.loadString(sp + 8)
 	b.storeValue(sp+24, str)
 }
 
-//export valueGet
-func valueGet(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
+func (b *Bridge) valueGet(sp int32) {
 	str := b.loadString(sp + 16)
 	val := b.loadValue(sp + 8)
 	sp = b.getSP()
-	obj, ok := val.(*object)
+	obj, ok := val.(propGetter)
 	if !ok {
 		b.storeValue(sp+32, val)
 		return
 	}
 
-	res, ok := obj.props[str]
+	res, ok := obj.get(str)
 	if !ok {
-		panic(fmt.Sprintln("missing property", str, val))
+		// modern guests look properties up to tell whether they're there
+		if !b.modern {
+			panic(fmt.Sprintln("missing property", str, val))
+		}
+		b.logger.Debug("missing property", "prop", str, "value", describe(val))
+		res = undefined
 	}
 	b.storeValue(sp+32, res)
 }
 
-//export valueSet
-func valueSet(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
+func (b *Bridge) valueSet(sp int32) {
 	val := b.loadValue(sp + 8)
-	obj := val.(*object)
 	prop := b.loadString(sp + 16)
 	propVal := b.loadValue(sp + 32)
-	obj.props[prop] = propVal
+	switch obj := val.(type) {
+	case *object:
+		obj.props[prop] = propVal
+	case *hostObject:
+		if err := obj.set(prop, propVal); err != nil {
+			panic(fmt.Sprintf("valueSet: %v", err))
+		}
+	default:
+		panic(fmt.Sprintf("valueSet on %T", val))
+	}
 }
 
-//export valueIndex
-func valueIndex(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
+func (b *Bridge) valueDelete(sp int32) {
+	val := b.loadValue(sp + 8)
+	prop := b.loadString(sp + 16)
+	obj, ok := val.(*object)
+	if !ok {
+		panic(fmt.Sprintf("valueDelete on %T", val))
+	}
+
+	delete(obj.props, prop)
+}
+
+func (b *Bridge) valueIndex(sp int32) {
 	l := b.loadValue(sp + 8)
 	i := b.getInt64(sp + 16)
+	if arr, ok := l.(*array); ok {
+		checkReleased(arr)
+		if i < 0 || int(i) >= arr.length() {
+			b.storeValue(sp+24, undefined)
+			return
+		}
+		b.storeValue(sp+24, arr.index(int(i)))
+		return
+	}
+
 	rv := reflect.ValueOf(l)
 	if rv.Kind() == reflect.Ptr {
 		rv = rv.Elem()
@@ -149,25 +143,39 @@ func valueIndex(ctx unsafe.Pointer, sp int32) {
 	b.storeValue(sp+24, iv.Interface())
 }
 
-//export valueSetIndex
-func valueSetIndex(_ unsafe.Pointer, _ int32) {
-	panic("valueSetIndex")
+func (b *Bridge) valueSetIndex(sp int32) {
+	l := b.loadValue(sp + 8)
+	i := int(b.getInt64(sp + 16))
+	v := b.loadValue(sp + 24)
+	switch l := l.(type) {
+	case *array:
+		checkReleased(l)
+		l.setIndex(i, toFloat(v))
+	case *[]interface{}:
+		(*l)[i] = v
+	default:
+		panic(fmt.Sprintf("valueSetIndex on %T", l))
+	}
 }
 
-//export valueCall
-func valueCall(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
+func (b *Bridge) valueCall(sp int32) {
 	v := b.loadValue(sp + 8)
 	str := b.loadString(sp + 16)
 	args := b.loadSliceOfValues(sp + 32)
-	f, ok := v.(*object).props[str].(Func)
-	if !ok {
-		panic(fmt.Sprintf("valueCall: prop not found in %v, %s", v.(*object).name, str))
+	var f Method
+	if obj, ok := v.(propGetter); ok {
+		prop, _ := obj.get(str)
+		f, _ = asMethod(prop)
 	}
+	if f == nil {
+		panic(fmt.Sprintf("valueCall: prop not found in %T, %s", v, str))
+	}
+	var res interface{}
+	var err error
+	b.hostCall(func() { res, err = f(v, args) })
 	sp = b.getSP()
-	res, err := f(args)
 	if err != nil {
-		b.storeValue(sp+56, err.Error())
+		b.storeValue(sp+56, thrown(err))
 		b.setUint8(sp+64, 0)
 		return
 	}
@@ -176,12 +184,30 @@ func valueCall(ctx unsafe.Pointer, sp int32) {
 	b.setUint8(sp+64, 1)
 }
 
-//export valueInvoke
-func valueInvoke(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
-	val := *(b.loadValue(sp + 8).(*Func))
+// thrown returns what the guest catches for err: its JS error object if it has
+// one, an Error with its message otherwise.
+func thrown(err error) interface{} {
+	var jsErr interface{ object() *object }
+	if errors.As(err, &jsErr) {
+		return jsErr.object()
+	}
+
+	return propObject("Error", map[string]interface{}{
+		"name":    "Error",
+		"message": err.Error(),
+	})
+}
+
+func (b *Bridge) valueInvoke(sp int32) {
+	f := b.loadValue(sp + 8)
+	val, ok := asMethod(f)
+	if !ok {
+		panic(fmt.Sprintf("valueInvoke on %T", f))
+	}
 	args := b.loadSliceOfValues(sp + 16)
-	res, err := val(args)
+	var res interface{}
+	var err error
+	b.hostCall(func() { res, err = val(undefined, args) })
 	sp = b.getSP()
 	if err != nil {
 		b.storeValue(sp+40, err)
@@ -193,20 +219,23 @@ func valueInvoke(ctx unsafe.Pointer, sp int32) {
 	b.setUint8(sp+48, 1)
 }
 
-//export valueNew
-func valueNew(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
+func (b *Bridge) valueNew(sp int32) {
 	val := b.loadValue(sp + 8)
 	args := b.loadSliceOfValues(sp + 16)
-	res := val.(*object).new(args)
+	var res interface{}
+	b.hostCall(func() { res = val.(*object).new(args) })
 	sp = b.getSP()
+	if err, ok := res.(error); ok {
+		b.storeValue(sp+40, thrown(err))
+		b.setUint8(sp+48, 0)
+		return
+	}
+
 	b.storeValue(sp+40, res)
 	b.setUint8(sp+48, 1)
 }
 
-//export valueLength
-func valueLength(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
+func (b *Bridge) valueLength(sp int32) {
 	val := b.loadValue(sp + 8)
 	rv := reflect.ValueOf(val)
 	if rv.Kind() == reflect.Ptr {
@@ -217,7 +246,7 @@ func valueLength(ctx unsafe.Pointer, sp int32) {
 	case rv.Kind() == reflect.Slice:
 		l = rv.Len()
 	case rv.Type() == reflect.TypeOf(array{}):
-		l = len(val.(*array).buf)
+		l = val.(*array).length()
 	default:
 		panic(fmt.Sprintf("valueLength on %T", val))
 	}
@@ -225,9 +254,7 @@ func valueLength(ctx unsafe.Pointer, sp int32) {
 	b.setInt64(sp+16, int64(l))
 }
 
-//export valuePrepareString
-func valuePrepareString(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
+func (b *Bridge) valuePrepareString(sp int32) {
 	val := b.loadValue(sp + 8)
 	var str string
 	if val != nil {
@@ -238,92 +265,216 @@ func valuePrepareString(ctx unsafe.Pointer, sp int32) {
 	b.setInt64(sp+24, int64(len(str)))
 }
 
-//export valueLoadString
-func valueLoadString(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
+func (b *Bridge) valueLoadString(sp int32) {
 	str := b.loadValue(sp + 8).(string)
 	sl := b.loadSlice(sp + 16)
 	copy(sl, str)
+	b.wroteSlice(sp + 16)
 }
 
-//export scheduleTimeoutEvent
-func scheduleTimeoutEvent(_ unsafe.Pointer, _ int32) {
-	panic("scheduleTimeoutEvent")
+func (b *Bridge) valueInstanceOf(sp int32) {
+	var is uint8
+	if instanceOf(b.loadValue(sp+8), b.loadValue(sp+16)) {
+		is = 1
+	}
+
+	b.setUint8(sp+24, is)
 }
 
-//export clearTimeoutEvent
-func clearTimeoutEvent(_ unsafe.Pointer, _ int32) {
-	panic("clearTimeoutEvent")
+// finalizeRef drops a reference of the guest to the value of an id. The value
+// is released, and its id reused, once the guest holds no reference to it.
+func (b *Bridge) finalizeRef(sp int32) {
+	id := int(b.getUint32(sp + 8))
+	b.valuesMu.Lock()
+	defer b.valuesMu.Unlock()
+	if _, ok := b.refCounts[id]; !ok {
+		// the predefined values, which are never released
+		return
+	}
+
+	b.refCounts[id]--
+	if b.refCounts[id] > 0 {
+		return
+	}
+
+	delete(b.refs, refKey(b.valueMap[id]))
+	delete(b.valueMap, id)
+	delete(b.refCounts, id)
+	b.idPool = append(b.idPool, id)
+}
+
+func (b *Bridge) resetMemoryDataView(sp int32) {
+	// the memory is looked up again on every import call
 }
 
-//export copyBytesToJS
-func copyBytesToJS(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
-	dst, ok := b.loadValue(sp + 8).(*array)
+func (b *Bridge) scheduleTimeoutEvent(sp int32) {
+	delay := time.Duration(b.getInt64(sp+8)) * time.Millisecond
+	if !b.modern {
+		// as wasm_exec.js of Go 1.13 does, timeouts have been seen to fire
+		// up to a millisecond early
+		delay += time.Millisecond
+	}
+	b.setInt32(sp+16, b.scheduleTimeout(delay))
+}
+
+func (b *Bridge) clearTimeoutEvent(sp int32) {
+	b.clearTimeout(b.getInt32(sp + 8))
+}
+
+func (b *Bridge) copyBytesToJS(sp int32) {
+	v := b.loadValue(sp + 8)
+	checkReleased(v)
+	dst, ok := byteView(v)
 	if !ok {
 		b.setUint8(sp+48, 0)
 		return
 	}
 	src := b.loadSlice(sp + 16)
-	n := copy(dst.buf, src[:len(dst.buf)])
+	n := copy(dst, src)
+	if b.metrics != nil {
+		b.metrics.Count(b.metricsKey, MetricBytesToHost, "", int64(n))
+	}
 	b.setInt64(sp+40, int64(n))
 	b.setUint8(sp+48, 1)
 }
 
-//export copyBytesToGo
-func copyBytesToGo(ctx unsafe.Pointer, sp int32) {
-	b := getBridge(ctx)
+func (b *Bridge) copyBytesToGo(sp int32) {
 	dst := b.loadSlice(sp + 8)
-	src, ok := b.loadValue(sp + 32).(*array)
+	v := b.loadValue(sp + 32)
+	checkReleased(v)
+	src, ok := byteView(v)
 	if !ok {
 		b.setUint8(sp+48, 0)
 		return
 	}
-	n := copy(dst, src.buf[:len(dst)])
+	n := copy(dst, src)
+	if b.metrics != nil {
+		b.metrics.Count(b.metricsKey, MetricBytesToGuest, "", int64(n))
+	}
+	b.wroteSlice(sp + 8)
 	b.setInt64(sp+40, int64(n))
 	b.setUint8(sp+48, 1)
 }
 
-// addImports adds go Bridge imports in "go" namespace.
-func (b *Bridge) addImports(imps *wasmer.Imports) error {
-	imps = imps.Namespace("go")
-	var is = []struct {
-		name string
-		imp  interface{}
-		cgo  unsafe.Pointer
-	}{
-		{"debug", debug, C.debug},
-		{"runtime.wasmExit", wexit, C.wexit},
-		{"runtime.wasmWrite", wwrite, C.wwrite},
-		{"runtime.nanotime", nanotime, C.nanotime},
-		{"runtime.walltime", walltime, C.walltime},
-		{"runtime.scheduleCallback", scheduleCallback, C.scheduleCallback},
-		{"runtime.clearScheduledCallback", clearScheduledCallback, C.clearScheduledCallback},
-		{"runtime.getRandomData", getRandomData, C.getRandomData},
-		{"runtime.scheduleTimeoutEvent", scheduleTimeoutEvent, C.scheduleTimeoutEvent},
-		{"runtime.clearTimeoutEvent", clearTimeoutEvent, C.clearTimeoutEvent},
-		{"syscall/js.stringVal", stringVal, C.stringVal},
-		{"syscall/js.valueGet", valueGet, C.valueGet},
-		{"syscall/js.valueSet", valueSet, C.valueSet},
-		{"syscall/js.valueIndex", valueIndex, C.valueIndex},
-		{"syscall/js.valueSetIndex", valueSetIndex, C.valueSetIndex},
-		{"syscall/js.valueCall", valueCall, C.valueCall},
-		{"syscall/js.valueInvoke", valueInvoke, C.valueInvoke},
-		{"syscall/js.valueNew", valueNew, C.valueNew},
-		{"syscall/js.valueLength", valueLength, C.valueLength},
-		{"syscall/js.valuePrepareString", valuePrepareString, C.valuePrepareString},
-		{"syscall/js.valueLoadString", valueLoadString, C.valueLoadString},
-		{"syscall/js.copyBytesToGo", copyBytesToGo, C.copyBytesToGo},
-		{"syscall/js.copyBytesToJS", copyBytesToJS, C.copyBytesToJS},
+// abort stops the guest from an import, which must not return to it: the call
+// into the guest that is running returns err, or the error the guest was
+// aborted with first.
+func (b *Bridge) abort(err error) {
+	if b.aborted == nil {
+		b.aborted = err
 	}
+	panic(b.aborted)
+}
 
-	var err error
-	for _, imp := range is {
-		imps, err = imps.Append(imp.name, imp.imp, imp.cgo)
-		if err != nil {
-			return err
+// importPanic returns the error to abort the guest with for the panic r of the
+// import name, which may be a host function it called, with the guest's stack.
+func (b *Bridge) importPanic(name string, r interface{}) error {
+	if err, ok := r.(error); ok && err == b.aborted {
+		return err
+	}
+
+	b.logger.Error("import panicked", "import", name, "panic", r, "stack", string(rdebug.Stack()))
+	err, ok := r.(error)
+	if !ok {
+		err = fmt.Errorf("%v", r)
+	}
+
+	// the guest's stack may have moved if the import called back into it
+	trap := &GuestTrap{Bridge: b.name, Reason: fmt.Sprintf("%s panicked: %v", name, r), Err: err}
+	func() {
+		defer func() { recover() }()
+		trap.Frames = b.stack(name, b.getSP())
+	}()
+
+	return trap
+}
+
+// imports returns the bridge's implementation of the "go" namespace imported by
+// wasm built with GOOS=js, keyed by import name. Go 1.21 and later import it as
+// "gojs".
+func (b *Bridge) imports() map[string]func(sp int32) {
+	is := map[string]func(sp int32){
+		"debug":                          b.debug,
+		"runtime.wasmExit":               b.wexit,
+		"runtime.wasmWrite":              b.wwrite,
+		"runtime.nanotime":               b.nanotime,
+		"runtime.nanotime1":              b.nanotime,
+		"runtime.walltime":               b.walltime,
+		"runtime.walltime1":              b.walltime,
+		"runtime.resetMemoryDataView":    b.resetMemoryDataView,
+		"runtime.scheduleCallback":       b.scheduleCallback,
+		"runtime.clearScheduledCallback": b.clearScheduledCallback,
+		"runtime.getRandomData":          b.getRandomData,
+		"runtime.scheduleTimeoutEvent":   b.scheduleTimeoutEvent,
+		"runtime.clearTimeoutEvent":      b.clearTimeoutEvent,
+		"syscall/js.finalizeRef":         b.finalizeRef,
+		"syscall/js.stringVal":           b.stringVal,
+		"syscall/js.valueGet":            b.valueGet,
+		"syscall/js.valueSet":            b.valueSet,
+		"syscall/js.valueDelete":         b.valueDelete,
+		"syscall/js.valueIndex":          b.valueIndex,
+		"syscall/js.valueSetIndex":       b.valueSetIndex,
+		"syscall/js.valueCall":           b.valueCall,
+		"syscall/js.valueInvoke":         b.valueInvoke,
+		"syscall/js.valueNew":            b.valueNew,
+		"syscall/js.valueLength":         b.valueLength,
+		"syscall/js.valuePrepareString":  b.valuePrepareString,
+		"syscall/js.valueLoadString":     b.valueLoadString,
+		"syscall/js.valueInstanceOf":     b.valueInstanceOf,
+		"syscall/js.copyBytesToGo":       b.copyBytesToGo,
+		"syscall/js.copyBytesToJS":       b.copyBytesToJS,
+	}
+
+	for name, imp := range is {
+		name, imp := name, imp
+		is[name] = func(sp int32) {
+			defer func() {
+				if r := recover(); r != nil {
+					b.abort(b.importPanic(name, r))
+				}
+			}()
+
+			// a host function aborted the guest called it back
+			defer func() {
+				if b.aborted != nil {
+					b.abort(b.aborted)
+				}
+			}()
+
+			// guest may have grown the memory since it last called us
+			b.memory = nil
+			if b.replay != nil {
+				b.replay.call(b, name, sp, imp)
+				return
+			}
+
+			if b.metrics != nil {
+				b.metrics.Count(b.metricsKey, MetricImportCalls, name, 1)
+			}
+
+			var end func(result string)
+			if b.tracer != nil && tracedImports[name] {
+				end = b.tracer.StartCall(HostCall{Bridge: b.name, Instance: b.id, Import: name, Args: b.describeArgs(name, sp)})
+			}
+			if b.rec != nil || end != nil {
+				b.results = append(b.results, "")
+				defer func() {
+					res := b.results[len(b.results)-1]
+					b.results = b.results[:len(b.results)-1]
+					if end != nil {
+						end(res)
+					}
+				}()
+			}
+
+			if b.rec != nil {
+				b.rec.call(b, name, sp, imp)
+				return
+			}
+
+			imp(sp)
 		}
 	}
 
-	return nil
+	return is
 }
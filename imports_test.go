@@ -0,0 +1,61 @@
+package wasm_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestModernGuest(t *testing.T) {
+	b := startBridge(t, modernFunctionModule(t))
+	res, err := b.CallFunc("addition", []interface{}{3, 4})
+	if err != nil || res != float64(7) {
+		t.Fatalf("addition(3, 4) = %v, %v, want 7", res, err)
+	}
+
+	res, err = b.CallFunc("getError", nil)
+	if s, serr := wasm.String(res); err != nil || serr != nil || s != "test errors" {
+		t.Errorf("getError() = %v, %v", res, err)
+	}
+
+	stats, err := b.GuestStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the values the guest no longer holds are released, once its garbage
+	// collector got to them
+	in := make([]byte, 1<<20)
+	for i := 0; i < 200; i++ {
+		res, err := b.CallFunc("bytes", []interface{}{wasm.FromBytes(in)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := wasm.Bytes(res); err != nil || !bytes.Equal(out, in) {
+			t.Fatalf("bytes() = %d bytes, %v", len(out), err)
+		}
+	}
+
+	after, err := b.GuestStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Values > stats.Values+100 {
+		t.Errorf("guest holds %d values after 200 calls, %d before", after.Values, stats.Values)
+	}
+}
+
+func TestModernGuestOnWasmer(t *testing.T) {
+	for _, e := range wasm.Engines() {
+		if e.Name() != "wasmer" {
+			continue
+		}
+
+		_, err := wasm.NewModule(e, modernFunctionWasm(t))
+		if err == nil || !strings.Contains(err.Error(), "WazeroEngine") {
+			t.Errorf("compiling a guest of this Go on wasmer: got %v, want a hint to use wazero", err)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package wasm
+
+import (
+	"context"
+	"log/slog"
+)
+
+// WithLogger makes the bridge log its diagnostics to l, with the attributes
+// bridge, its name, and instance, a number unique to the process. Bridges are
+// silent by default.
+func WithLogger(l *slog.Logger) Option {
+	return func(b *Bridge) {
+		b.logger = l
+	}
+}
+
+// discardHandler drops the records of the default logger.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,88 @@
+package wasm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+// stopBridge runs a bridge of functionWasm named name with opts until it
+// returned from its main, then stops it.
+func stopBridge(t *testing.T, name string, opts ...wasm.Option) *wasm.Bridge {
+	t.Helper()
+	b, err := functionModule(t, wasm.WazeroEngine()).NewBridge(name, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	b.SetFunc("addProxy", func(args []interface{}) (interface{}, error) {
+		return b.CallFunc("addition", args)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	init := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx, init)
+	}()
+	if err := <-init; err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	<-done
+	return b
+}
+
+func TestWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	b := stopBridge(t, "logged", wasm.WithLogger(logger), wasm.WithStdio(nil, &bytes.Buffer{}, &bytes.Buffer{}))
+
+	var stopped bool
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var r struct {
+			Msg      string
+			Bridge   string
+			Instance uint64
+		}
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Bridge != "logged" || r.Instance != b.Instance() {
+			t.Errorf("got %q of bridge %q instance %d, want %q instance %d", r.Msg, r.Bridge, r.Instance, "logged", b.Instance())
+		}
+		stopped = stopped || r.Msg == "stopping instance"
+	}
+
+	if !stopped {
+		t.Errorf("got no record of the stop in %q", buf.String())
+	}
+}
+
+func TestLoggerSilentByDefault(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	var stdout, stderr bytes.Buffer
+	stopBridge(t, "silent", wasm.WithStdio(nil, &stdout, &stderr))
+	if buf.Len() != 0 {
+		t.Errorf("the bridge logged to the default logger: %q", buf.String())
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("the bridge logged to the guest's stdout: %q", stdout.String())
+	}
+	// only the guest's own output
+	if got, want := stderr.String(), "1 + 2 = 3\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("got stderr %q, want the guest's %q", got, want)
+	}
+}
@@ -0,0 +1,164 @@
+package wasm
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics reported by bridges.
+const (
+	MetricImportCalls     = "import_calls"     // counter of the imports called by the guest, labelled by import
+	MetricBytesToGuest    = "bytes_to_guest"   // counter of the bytes copied by js.CopyBytesToGo
+	MetricBytesToHost     = "bytes_to_host"    // counter of the bytes copied by js.CopyBytesToJS
+	MetricResumes         = "resumes"          // counter of the times the guest was resumed
+	MetricResumeSeconds   = "resume_seconds"   // histogram of the time the guest ran once resumed
+	MetricCallFuncSeconds = "callfunc_seconds" // histogram of the time taken by CallFunc
+	MetricValues          = "values"           // gauge of the values held for the guest
+	MetricMemoryBytes     = "memory_bytes"     // gauge of the size of the guest's memory
+)
+
+// Metrics receives the measurements of bridges, keyed by the bridge name and
+// instance number, as in "name#3", so that bridges sharing a name, like those
+// of a Pool, are kept apart. Bridges report from their own goroutines, so
+// implementations must be safe for concurrent use.
+type Metrics interface {
+	// Count adds delta to the counter metric. label is empty for unlabelled counters.
+	Count(bridge, metric, label string, delta int64)
+
+	// Set sets the gauge metric.
+	Set(bridge, metric string, v float64)
+
+	// Observe adds v to the histogram metric.
+	Observe(bridge, metric string, v float64)
+
+	// Remove drops the metrics of a closed bridge.
+	Remove(bridge string)
+}
+
+// WithMetrics makes the bridge report its activity to m.
+func WithMetrics(m Metrics) Option {
+	return func(b *Bridge) {
+		b.metrics = m
+	}
+}
+
+// ExpvarMetrics returns Metrics published as the expvar name, a map from the
+// bridge key to its metrics. Histograms are published with their count, sum
+// and cumulative buckets of seconds. Like expvar.Publish, it panics if name is
+// already in use.
+func ExpvarMetrics(name string) Metrics {
+	return &expvarMetrics{m: expvar.NewMap(name)}
+}
+
+type expvarMetrics struct {
+	mu sync.Mutex // serialises the creation of vars
+	m  *expvar.Map
+}
+
+// get returns the var metric of bridge, creating it with create if needed.
+func (e *expvarMetrics) get(bridge, metric string, create func() expvar.Var) expvar.Var {
+	bm, _ := e.m.Get(bridge).(*expvar.Map)
+	if bm != nil {
+		if v := bm.Get(metric); v != nil {
+			return v
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	bm, _ = e.m.Get(bridge).(*expvar.Map)
+	if bm == nil {
+		bm = new(expvar.Map)
+		e.m.Set(bridge, bm)
+	}
+
+	v := bm.Get(metric)
+	if v == nil {
+		v = create()
+		bm.Set(metric, v)
+	}
+
+	return v
+}
+
+func (e *expvarMetrics) Count(bridge, metric, label string, delta int64) {
+	if label == "" {
+		e.get(bridge, metric, func() expvar.Var { return new(expvar.Int) }).(*expvar.Int).Add(delta)
+		return
+	}
+
+	e.get(bridge, metric, func() expvar.Var { return new(expvar.Map) }).(*expvar.Map).Add(label, delta)
+}
+
+func (e *expvarMetrics) Set(bridge, metric string, v float64) {
+	e.get(bridge, metric, func() expvar.Var { return new(expvar.Float) }).(*expvar.Float).Set(v)
+}
+
+func (e *expvarMetrics) Observe(bridge, metric string, v float64) {
+	e.get(bridge, metric, func() expvar.Var { return newHistogram() }).(*histogram).observe(v)
+}
+
+func (e *expvarMetrics) Remove(bridge string) {
+	e.m.Delete(bridge)
+}
+
+// histogramBuckets are the upper bounds of the histogram buckets, in seconds.
+var histogramBuckets = []float64{1e-5, 1e-4, 1e-3, 1e-2, 0.1, 1, 10}
+
+type histogram struct {
+	mu     sync.Mutex
+	count  int64
+	sum    float64
+	counts []int64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int64, len(histogramBuckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count++
+	h.sum += v
+	for i, le := range histogramBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+}
+
+// String returns the histogram as JSON, as expvar.Var requires.
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make([]string, len(histogramBuckets))
+	for i, le := range histogramBuckets {
+		buckets[i] = fmt.Sprintf("%q: %d", strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+	}
+
+	return fmt.Sprintf(`{"count": %d, "sum": %s, "buckets": {%s}}`,
+		h.count, strconv.FormatFloat(h.sum, 'g', -1, 64), strings.Join(buckets, ", "))
+}
+
+// resumed reports a resume of the guest, started at start.
+func (b *Bridge) resumed(start time.Time, err error) {
+	b.metrics.Count(b.metricsKey, MetricResumes, "", 1)
+	b.metrics.Observe(b.metricsKey, MetricResumeSeconds, time.Since(start).Seconds())
+	if err == nil {
+		b.reportSizes()
+	}
+}
+
+// reportSizes reports the gauges once the guest returned.
+func (b *Bridge) reportSizes() {
+	b.valuesMu.RLock()
+	n := len(b.valueMap)
+	b.valuesMu.RUnlock()
+	b.metrics.Set(b.metricsKey, MetricValues, float64(n))
+	b.metrics.Set(b.metricsKey, MetricMemoryBytes, float64(len(b.instance.Memory())))
+}
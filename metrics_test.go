@@ -0,0 +1,91 @@
+package wasm_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestExpvarMetrics(t *testing.T) {
+	metrics := wasm.ExpvarMetrics("wasm_test_metrics")
+	published := expvar.Get("wasm_test_metrics").(*expvar.Map)
+	m := functionModule(t, wasm.WazeroEngine())
+
+	// two bridges of the same name, reporting apart
+	var bridges []*wasm.Bridge
+	for i := 0; i < 2; i++ {
+		b := startBridge(t, m, wasm.WithMetrics(metrics))
+		bridges = append(bridges, b)
+	}
+
+	key := func(b *wasm.Bridge) string {
+		return b.Name() + "#" + strconv.FormatUint(b.Instance(), 10)
+	}
+
+	toHost := func(b *wasm.Bridge) int64 {
+		v, _ := published.Get(key(b)).(*expvar.Map).Get(wasm.MetricBytesToHost).(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+
+	before := toHost(bridges[0])
+	in := []byte{1, 2, 3, 4}
+	if _, err := bridges[0].CallFunc("bytes", []interface{}{wasm.FromBytes(in)}); err != nil {
+		t.Fatal(err)
+	}
+
+	vars := func(b *wasm.Bridge) *expvar.Map {
+		t.Helper()
+		v, _ := published.Get(key(b)).(*expvar.Map)
+		if v == nil {
+			t.Fatalf("no metrics for %s in %s", key(b), published)
+		}
+		return v
+	}
+
+	b := vars(bridges[0])
+	if n := b.Get(wasm.MetricBytesToGuest).(*expvar.Int).Value(); n != int64(len(in)) {
+		t.Errorf("got %d bytes to the guest, want %d", n, len(in))
+	}
+	if n := toHost(bridges[0]) - before; n != int64(len(in)) {
+		t.Errorf("got %d bytes to the host, want %d", n, len(in))
+	}
+	if n := b.Get(wasm.MetricImportCalls).(*expvar.Map).Get("syscall/js.copyBytesToGo"); n == nil || n.(*expvar.Int).Value() != 1 {
+		t.Errorf("got %v calls of copyBytesToGo, want 1", n)
+	}
+	if n := b.Get(wasm.MetricResumes).(*expvar.Int).Value(); n == 0 {
+		t.Error("no resumes")
+	}
+	if n := b.Get(wasm.MetricMemoryBytes).(*expvar.Float).Value(); n <= 0 {
+		t.Errorf("got %v bytes of memory", n)
+	}
+
+	var h struct {
+		Count   int64
+		Sum     float64
+		Buckets map[string]int64
+	}
+	if err := json.Unmarshal([]byte(b.Get(wasm.MetricCallFuncSeconds).String()), &h); err != nil {
+		t.Fatal(err)
+	}
+	// addProxy called addition once, then the test called bytes
+	if h.Count != 2 || h.Buckets["10"] != 2 || len(h.Buckets) != 7 {
+		t.Errorf("got CallFunc histogram %+v, want 2 calls", h)
+	}
+
+	if v := vars(bridges[1]).Get(wasm.MetricBytesToGuest); v != nil {
+		t.Errorf("got %s bytes to the guest of the other bridge, want none", v)
+	}
+
+	// closing a bridge drops its metrics only
+	bridges[0].Close()
+	if v := published.Get(key(bridges[0])); v != nil {
+		t.Errorf("got metrics of the closed bridge: %s", v)
+	}
+	vars(bridges[1])
+}
@@ -0,0 +1,57 @@
+package wasm
+
+import (
+	"os"
+)
+
+// Module is a compiled wasm module. Compiling is the expensive part of creating
+// a Bridge, a Module does it once and can then instantiate any number of
+// independent Bridges, each with its own memory and values.
+//
+// A Module is safe for concurrent use.
+type Module struct {
+	module    CompiledModule
+	goVersion string
+	modern    bool     // see modernABI
+	symbols   *symbols // to read the guest's stack
+	cacheErr  error    // see CacheErr
+}
+
+func newModule(m CompiledModule, bytes []byte) *Module {
+	return &Module{module: m, goVersion: goVersion(bytes), modern: modernABI(bytes), symbols: newSymbols(bytes)}
+}
+
+// CompileModule compiles the wasm bytes on the DefaultEngine.
+func CompileModule(bytes []byte) (*Module, error) {
+	return NewModule(DefaultEngine(), bytes)
+}
+
+// NewModule compiles the wasm bytes on e.
+func NewModule(e Engine, bytes []byte) (*Module, error) {
+	m, err := e.Compile(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return newModule(m, bytes), nil
+}
+
+// CompileFile compiles the wasm file.
+func CompileFile(file string) (*Module, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return CompileModule(bytes)
+}
+
+// NewBridge instantiates a new Bridge from the module. name is as for BridgeFromBytes.
+func (m *Module) NewBridge(name string, opts ...Option) (*Bridge, error) {
+	return newBridge(name, m, opts)
+}
+
+// Close frees the compiled module. Bridges already created from it are not affected.
+func (m *Module) Close() {
+	m.module.Close()
+}
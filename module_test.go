@@ -0,0 +1,32 @@
+package wasm_test
+
+import (
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestModuleBridges(t *testing.T) {
+	forEngines(t, func(t *testing.T, e wasm.Engine) {
+		applied := 0
+		counted := func(b *wasm.Bridge) { applied++ }
+		b1 := startFunction(t, e, counted)
+		b2 := startFunction(t, e, counted)
+		if applied != 2 {
+			t.Errorf("options applied %d times for 2 bridges", applied)
+		}
+
+		if err := b1.SetValue("only.b1", 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b2.GetValue("only.b1"); err == nil {
+			t.Error("value set on a bridge is seen by another of the module")
+		}
+
+		for _, b := range []*wasm.Bridge{b1, b2} {
+			if res, err := b.CallFunc("multiplier", nil); err != nil || res != float64(10) {
+				t.Errorf("%s: multiplier() = %v, %v, want 10", b.Name(), res, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by Get once the pool is closed.
+var ErrPoolClosed = errors.New("wasm: pool is closed")
+
+// PoolConfig configures a Pool.
+type PoolConfig struct {
+	// Size is the number of bridges kept ready.
+	Size int
+
+	// MaxUses recycles a bridge after it was checked out this many times. 0 means no limit.
+	MaxUses int
+
+	// MaxMemory recycles a bridge once its guest memory is larger than this
+	// many bytes. 0 means no limit.
+	MaxMemory int
+
+	// Setup is called on each new bridge before it is run, to register the host
+	// functions and values the guest expects.
+	Setup func(b *Bridge) error
+
+	// Reset is called on each returned bridge that is kept. A bridge for which
+	// it fails is replaced.
+	Reset func(b *Bridge) error
+
+	// Options are passed to every bridge.
+	Options []Option
+}
+
+// Pool keeps bridges of a module ready to be used, i.e. already past their
+// guest's main. Get checks one out and Put returns it. Bridges that were
+// closed, whose guest exited or trapped, or that reached MaxUses or MaxMemory
+// are replaced by fresh ones in the background.
+//
+// A Pool is safe for concurrent use.
+type Pool struct {
+	m   *Module
+	cfg PoolConfig
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	idle   chan *Bridge
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex // protects uses and closed
+	uses   map[*Bridge]int
+	closed bool
+}
+
+// NewPool creates a pool of bridges instantiated from m and starts them.
+func NewPool(m *Module, cfg PoolConfig) (*Pool, error) {
+	if cfg.Size < 1 {
+		return nil, errors.New("pool size must be at least 1")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		m:      m,
+		cfg:    cfg,
+		ctx:    ctx,
+		cancel: cancel,
+		idle:   make(chan *Bridge, cfg.Size),
+		uses:   make(map[*Bridge]int),
+	}
+
+	for i := 0; i < cfg.Size; i++ {
+		b, err := p.start()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+
+		p.idle <- b
+	}
+
+	return p, nil
+}
+
+// start creates a bridge and runs its guest's main.
+func (p *Pool) start() (*Bridge, error) {
+	b, err := p.m.NewBridge("", p.cfg.Options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.cfg.Setup != nil {
+		if err := p.cfg.Setup(b); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+
+	init := make(chan error, 1)
+	go b.Run(p.ctx, init)
+	if err := <-init; err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Get checks out a bridge, waiting for one to be returned if all are in use.
+func (p *Pool) Get(ctx context.Context) (*Bridge, error) {
+	select {
+	case b := <-p.idle:
+		return b, nil
+	case <-p.ctx.Done():
+		return nil, ErrPoolClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Put returns a bridge checked out with Get. The bridge must not be used afterwards.
+func (p *Pool) Put(b *Bridge) {
+	p.mu.Lock()
+	p.uses[b]++
+	uses := p.uses[b]
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		b.Close()
+		return
+	}
+
+	keep := b.check() == nil &&
+		(p.cfg.MaxUses == 0 || uses < p.cfg.MaxUses) &&
+		(p.cfg.MaxMemory == 0 || b.MemorySize() <= p.cfg.MaxMemory)
+	if keep && p.cfg.Reset != nil {
+		keep = p.cfg.Reset(b) == nil
+	}
+
+	if !keep {
+		p.replace(b)
+		return
+	}
+
+	p.release(b)
+}
+
+// release puts b back in the idle set, or closes it if the pool was closed meanwhile.
+func (p *Pool) release(b *Bridge) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		b.Close()
+		return
+	}
+	// Close waits for b to be in idle before closing the idle bridges
+	p.wg.Add(1)
+	p.mu.Unlock()
+
+	defer p.wg.Done()
+	select {
+	case p.idle <- b:
+	default:
+		// b wasn't checked out of this pool, idle holds Size bridges at most
+		b.Close()
+	}
+}
+
+// replace closes b and starts a new bridge in its place.
+func (p *Pool) replace(b *Bridge) {
+	b.Close()
+	p.mu.Lock()
+	delete(p.uses, b)
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.wg.Add(1)
+	p.mu.Unlock()
+
+	go func() {
+		defer p.wg.Done()
+		backoff := 10 * time.Millisecond
+		for {
+			nb, err := p.start()
+			if err == nil {
+				p.release(nb)
+				return
+			}
+
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			if backoff < time.Second {
+				backoff *= 2
+			}
+		}
+	}()
+}
+
+// Close closes the idle bridges and stops the ones checked out. It waits for
+// pending replacements to finish.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	p.cancel()
+	p.wg.Wait()
+	for {
+		select {
+		case b := <-p.idle:
+			b.Close()
+		default:
+			return nil
+		}
+	}
+}
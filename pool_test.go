@@ -0,0 +1,87 @@
+package wasm_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestPool(t *testing.T) {
+	forEngines(t, func(t *testing.T, e wasm.Engine) {
+		var setups int32
+		p, err := wasm.NewPool(functionModule(t, e), wasm.PoolConfig{
+			Size:    2,
+			MaxUses: 2,
+			Setup: func(b *wasm.Bridge) error {
+				atomic.AddInt32(&setups, 1)
+				return b.SetFunc("addProxy", func(args []interface{}) (interface{}, error) {
+					return b.CallFunc("addition", args)
+				})
+			},
+			Options: []wasm.Option{wasm.WithStdio(nil, io.Discard, io.Discard)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+
+		ctx := context.Background()
+		get := func() *wasm.Bridge {
+			t.Helper()
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			b, err := p.Get(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res, err := b.CallFunc("multiplier", nil); err != nil || res != float64(10) {
+				t.Fatalf("multiplier() = %v, %v, want 10", res, err)
+			}
+			return b
+		}
+
+		b1, b2 := get(), get()
+		short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if _, err := p.Get(short); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Get with all bridges checked out: got %v, want %v", err, context.DeadlineExceeded)
+		}
+
+		p.Put(b1)
+		if b := get(); b != b1 {
+			t.Error("Get didn't return the idle bridge")
+		}
+
+		// used twice, it is replaced
+		p.Put(b1)
+		if b := get(); b == b1 {
+			t.Error("bridge used MaxUses times was kept")
+		} else {
+			p.Put(b)
+		}
+
+		// so is a closed one
+		b2.Close()
+		p.Put(b2)
+		get()
+		if b := get(); b == b2 {
+			t.Error("closed bridge was kept")
+		}
+
+		if n := atomic.LoadInt32(&setups); n != 4 {
+			t.Errorf("%d bridges set up, want 4", n)
+		}
+
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Get(ctx); !errors.Is(err, wasm.ErrPoolClosed) {
+			t.Errorf("Get after Close: got %v, want %v", err, wasm.ErrPoolClosed)
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// WithArgs sets the guest's os.Args, args[0] being the name of the program.
+func WithArgs(args ...string) Option {
+	return func(b *Bridge) {
+		b.args = args
+	}
+}
+
+// WithEnv sets the guest's environment, as key=value pairs like os.Environ's.
+func WithEnv(env ...string) Option {
+	return func(b *Bridge) {
+		b.env = env
+	}
+}
+
+// WithStdio makes stdin, stdout and stderr the guest's standard files. A nil
+// stdin reads as empty and the nil writers default to the host's own
+// os.Stdout and os.Stderr. Reading stdin blocks the guest, and its timers,
+// until the read returns.
+func WithStdio(stdin io.Reader, stdout, stderr io.Writer) Option {
+	return func(b *Bridge) {
+		b.stdin = stdin
+		if stdout != nil {
+			b.stdout = stdout
+		}
+		if stderr != nil {
+			b.stderr = stderr
+		}
+	}
+}
+
+// WithExitOnDeadlock is for guests that are programs, run to their end like
+// go_js_wasm_exec runs them. Once the guest waits with no timer pending,
+// nothing but the host calling it could wake it. With this option, Run then
+// makes the guest's runtime report the deadlock and exit with code 2, as Node.js
+// does when it has nothing left to do.
+func WithExitOnDeadlock() Option {
+	return func(b *Bridge) {
+		b.exitOnDeadlock = true
+	}
+}
+
+// ExitCode returns the code the guest exited with, once Run has returned. It
+// is 0 while the guest hasn't exited.
+func (b *Bridge) ExitCode() int {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+	return b.exitCode
+}
+
+// writeArgs writes the guest's args and env where the guest's runtime reads
+// them, as wasm_exec.js does, and returns the argc and argv of run.
+func (b *Bridge) writeArgs() (argc, argv int32, err error) {
+	if len(b.args) == 0 && len(b.env) == 0 {
+		return 0, 0, nil
+	}
+
+	args := b.args
+	if len(args) == 0 {
+		args = []string{"js"}
+	}
+
+	// the strings, each 8 bytes aligned, then the pointers to them, laid out
+	// from 4096 on
+	var buf []byte
+	var ptrs []uint64
+	str := func(s string) {
+		ptrs = append(ptrs, uint64(4096+len(buf)))
+		buf = append(buf, s...)
+		buf = append(buf, make([]byte, 8-len(buf)%8)...)
+	}
+
+	for _, arg := range args {
+		str(arg)
+	}
+	ptrs = append(ptrs, 0)
+	for _, kv := range b.env {
+		str(kv)
+	}
+	ptrs = append(ptrs, 0)
+
+	argv = int32(4096 + len(buf))
+	for _, ptr := range ptrs {
+		buf = binary.LittleEndian.AppendUint64(buf, ptr)
+	}
+
+	if limit := b.argsLimit(); 4096+len(buf) > limit {
+		return 0, 0, fmt.Errorf("wasm: args and env exceed the %d bytes the guest has room for", limit-4096)
+	}
+
+	copy(b.mem()[4096:], buf)
+	b.wrote(4096, len(buf))
+	return int32(len(args)), argv, nil
+}
+
+// argsLimit returns where the guest's data starts, the args and env are
+// written below it. Go 1.18 grew the room left for them from 4KB to 8KB.
+func (b *Bridge) argsLimit() int {
+	minor, _ := strconv.Atoi(strings.SplitN(strings.TrimPrefix(b.goVersion, "go1."), ".", 2)[0])
+	if minor >= 18 {
+		return 4096 + 8192
+	}
+
+	return 4096 + 4096
+}
+
+// wakeDeadlocked resumes the guest with the event 0 if it waits with no timer
+// pending, which makes its runtime report the deadlock and exit. It does
+// nothing unless the bridge was created WithExitOnDeadlock.
+func (b *Bridge) wakeDeadlocked() {
+	if !b.exitOnDeadlock {
+		return
+	}
+
+	leave, err := b.enter()
+	if err != nil {
+		return
+	}
+	defer leave()
+
+	b.timersMu.Lock()
+	timers := len(b.timers)
+	b.timersMu.Unlock()
+	if timers > 0 {
+		return
+	}
+
+	b.valuesMu.RLock()
+	goObj := b.valueMap[6].(*object)
+	b.valuesMu.RUnlock()
+	goObj.props["_pendingEvent"] = propObject("_pendingEvent", map[string]interface{}{"id": 0})
+	b.resume()
+}
+
+// writeStdout writes p to the guest's fd, 1 or 2.
+func (b *Bridge) writeStdout(fd int, p []byte) (int, error) {
+	if b.rec != nil {
+		b.rec.output(fd, p)
+	}
+
+	if fd == 2 {
+		b.wroteStderr(p)
+		return b.stderr.Write(p)
+	}
+
+	return b.stdout.Write(p)
+}
+
+// processObject returns the process object of the guest.
+func (b *Bridge) processObject() *object {
+	id := func(v int) Func {
+		return func(args []interface{}) (interface{}, error) {
+			return v, nil
+		}
+	}
+
+	return propObject("process", map[string]interface{}{
+		"pid":     os.Getpid(),
+		"ppid":    os.Getppid(),
+		"getuid":  id(os.Getuid()),
+		"getgid":  id(os.Getgid()),
+		"geteuid": id(os.Geteuid()),
+		"getegid": id(os.Getegid()),
+		"getgroups": Func(func(args []interface{}) (interface{}, error) {
+			groups, _ := os.Getgroups()
+			ids := make([]interface{}, len(groups))
+			for i, g := range groups {
+				ids[i] = g
+			}
+			return &ids, nil
+		}),
+		"umask": Func(func(args []interface{}) (interface{}, error) {
+			// the guest can't change the host's umask
+			return 0o022, nil
+		}),
+		"cwd": Func(func(args []interface{}) (interface{}, error) {
+			return b.files.cwd, nil
+		}),
+		"chdir": Func(func(args []interface{}) (interface{}, error) {
+			err := b.files.chdir(args[0].(string))
+			if err != nil {
+				return nil, &jsError{err: err}
+			}
+			return nil, nil
+		}),
+	})
+}
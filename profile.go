@@ -0,0 +1,284 @@
+package wasm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrProfilingUnsupported is returned by StartProfile when the engine of
+	// the bridge can't profile the guest.
+	ErrProfilingUnsupported = errors.New("wasm: engine can't profile the guest, use WazeroProfilingEngine")
+
+	// ErrProfiling is returned by StartProfile when the bridge is already profiled.
+	ErrProfiling = errors.New("wasm: bridge is already profiled")
+)
+
+// profilePeriod is the time between two samples, 100 a second like Go's CPU profiles.
+const profilePeriod = 10 * time.Millisecond
+
+// StartProfile starts a CPU profile of the guest, written to w in the pprof
+// format by StopProfile. Every profilePeriod the guest runs, a sample of its
+// stack is taken when it next calls one of its functions, so the time spent in
+// a loop without calls is put on the function that follows it. The bridge must
+// be created on WazeroProfilingEngine.
+func (b *Bridge) StartProfile(w io.Writer) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+
+	s, ok := b.instance.(Sampler)
+	if !ok {
+		return ErrProfilingUnsupported
+	}
+
+	b.profMu.Lock()
+	defer b.profMu.Unlock()
+	if b.prof != nil {
+		return ErrProfiling
+	}
+
+	p := &profile{w: w, start: time.Now(), samples: make(map[string]*[2]int64), stop: make(chan struct{}), done: make(chan struct{})}
+	b.prof = p
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(profilePeriod)
+		defer t.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-t.C:
+				now := time.Now()
+				// ticks are late when the guest keeps the CPUs busy, the
+				// samples are weighted by the time since the previous one
+				d := now.Sub(last)
+				last = now
+				if atomic.LoadInt32(&b.running) > 0 {
+					var sample func(stack []string)
+					sample = func(stack []string) {
+						if b.gettingSP {
+							// the host is done with an import, the
+							// sample goes to the guest's next call
+							s.Sample(sample)
+							return
+						}
+
+						// unless the guest went idle since
+						if time.Since(now) < profilePeriod {
+							p.add(stack, d)
+						}
+					}
+					s.Sample(sample)
+				}
+			case <-p.stop:
+				return
+			case <-b.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopProfile stops the profile started by StartProfile and writes it.
+func (b *Bridge) StopProfile() error {
+	b.profMu.Lock()
+	p := b.prof
+	b.prof = nil
+	b.profMu.Unlock()
+	if p == nil {
+		return errors.New("wasm: bridge is not profiled")
+	}
+
+	close(p.stop)
+	<-p.done
+	if s, ok := b.instance.(Sampler); ok {
+		s.Sample(nil)
+	}
+
+	return p.write(time.Since(p.start))
+}
+
+// ProfileHandler returns a handler serving CPU profiles of the guest of b,
+// like /debug/pprof/profile of net/http/pprof: the seconds parameter sets
+// their duration, 30 by default.
+func ProfileHandler(b *Bridge) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sec, err := strconv.ParseInt(r.FormValue("seconds"), 10, 64)
+		if sec <= 0 || err != nil {
+			sec = 30
+		}
+
+		var buf bytes.Buffer
+		if err := b.StartProfile(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		select {
+		case <-time.After(time.Duration(sec) * time.Second):
+		case <-r.Context().Done():
+		}
+
+		if err := b.StopProfile(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+		buf.WriteTo(w)
+	})
+}
+
+type profile struct {
+	w     io.Writer
+	start time.Time
+
+	mu      sync.Mutex
+	samples map[string]*[2]int64 // count and nanoseconds by stack, the functions joined with \x00
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (p *profile) add(stack []string, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := strings.Join(stack, "\x00")
+	v := p.samples[key]
+	if v == nil {
+		v = new([2]int64)
+		p.samples[key] = v
+	}
+	v[0]++
+	v[1] += int64(d)
+}
+
+// write writes the profile to w, as a gzipped profile.proto of pprof. The
+// functions have a single location each, wasm has no addresses to give.
+func (p *profile) write(d time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	strs := map[string]int64{"": 0}
+	table := []string{""}
+	str := func(s string) uint64 {
+		i, ok := strs[s]
+		if !ok {
+			i = int64(len(table))
+			strs[s] = i
+			table = append(table, s)
+		}
+		return uint64(i)
+	}
+
+	var out protobuf
+	valueType := func(tag int, typ, unit string) {
+		out.message(tag, func(m *protobuf) {
+			m.uint64(1, str(typ))
+			m.uint64(2, str(unit))
+		})
+	}
+
+	valueType(1, "samples", "count")
+	valueType(1, "cpu", "nanoseconds")
+	valueType(11, "cpu", "nanoseconds")
+	out.uint64(12, uint64(profilePeriod))
+	out.uint64(9, uint64(p.start.UnixNano()))
+	out.uint64(10, uint64(d))
+	funcs := make(map[string]uint64)
+	for key, v := range p.samples {
+		stack := strings.Split(key, "\x00")
+		ids := make([]uint64, len(stack))
+		for i, fn := range stack {
+			id, ok := funcs[fn]
+			if !ok {
+				id = uint64(len(funcs) + 1)
+				funcs[fn] = id
+			}
+			ids[i] = id
+		}
+
+		out.message(2, func(m *protobuf) {
+			m.packed(1, ids)
+			m.packed(2, []uint64{uint64(v[0]), uint64(v[1])})
+		})
+	}
+
+	for fn, id := range funcs {
+		id := id
+		out.message(4, func(m *protobuf) {
+			m.uint64(1, id)
+			m.message(4, func(m *protobuf) {
+				m.uint64(1, id)
+			})
+		})
+		name := str(fn)
+		out.message(5, func(m *protobuf) {
+			m.uint64(1, id)
+			m.uint64(2, name)
+			m.uint64(3, name)
+		})
+	}
+
+	// the strings are all referenced by now
+	for _, s := range table {
+		out.bytes(6, []byte(s))
+	}
+
+	zw := gzip.NewWriter(p.w)
+	if _, err := zw.Write(out.buf); err != nil {
+		return fmt.Errorf("writing profile: %v", err)
+	}
+
+	return zw.Close()
+}
+
+// protobuf encodes the few protocol buffer types profile.proto needs.
+type protobuf struct {
+	buf []byte
+}
+
+func (p *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		p.buf = append(p.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	p.buf = append(p.buf, byte(x))
+}
+
+func (p *protobuf) uint64(tag int, x uint64) {
+	p.varint(uint64(tag) << 3)
+	p.varint(x)
+}
+
+func (p *protobuf) bytes(tag int, b []byte) {
+	p.varint(uint64(tag)<<3 | 2)
+	p.varint(uint64(len(b)))
+	p.buf = append(p.buf, b...)
+}
+
+func (p *protobuf) packed(tag int, xs []uint64) {
+	var m protobuf
+	for _, x := range xs {
+		m.varint(x)
+	}
+	p.bytes(tag, m.buf)
+}
+
+func (p *protobuf) message(tag int, f func(m *protobuf)) {
+	var m protobuf
+	f(&m)
+	p.bytes(tag, m.buf)
+}
@@ -0,0 +1,75 @@
+package wasm_test
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestProfile(t *testing.T) {
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to read the profile")
+	}
+
+	m, err := wasm.NewModule(wasm.WazeroProfilingEngine(), buildGuest(t, "testdata/guest", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	b := newBridge(t, m)
+	if err := run(t, b); err != nil {
+		t.Fatal(err)
+	}
+
+	var prof bytes.Buffer
+	if err := b.StartProfile(&prof); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StartProfile(&prof); err != wasm.ErrProfiling {
+		t.Errorf("second StartProfile: got %v, want %v", err, wasm.ErrProfiling)
+	}
+	if _, err := b.CallFunc("busy", []interface{}{500}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StopProfile(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "profile")
+	if err := os.WriteFile(file, prof.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(goCmd, "tool", "pprof", "-top", file).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go tool pprof: %v\n%s", err, out)
+	}
+
+	// the header, then flat, flat%, sum%, cum, cum% and the function of each
+	// line, by flat time
+	var top []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if f := strings.Fields(l); len(f) == 6 && strings.HasSuffix(f[1], "%") {
+			top = append(top, f[5])
+		}
+	}
+	if !strings.Contains(string(out), "Type: cpu") || len(top) == 0 || top[0] != "main.work" {
+		t.Errorf("got profile, want main.work on top:\n%s", out)
+	}
+	if !strings.Contains(string(out), "main.main.func") {
+		t.Errorf("got profile, want the callers of main.work:\n%s", out)
+	}
+}
+
+func TestProfileUnsupported(t *testing.T) {
+	b := startFunction(t, wasm.WazeroEngine())
+	if err := b.StartProfile(new(bytes.Buffer)); err != wasm.ErrProfilingUnsupported {
+		t.Errorf("got %v, want %v", err, wasm.ErrProfilingUnsupported)
+	}
+}
@@ -0,0 +1,372 @@
+package wasm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A trace is a stream of JSON events, one per line. The guest is entered by a
+// run, with argc and argv, or a resume event and leaves it with an end event.
+// The args written for run come before it as w events. In between, each
+// import called by the guest is a call event, followed by the memory the
+// import wrote, by the guest entries it made through host functions and by a
+// ret event.
+type event struct {
+	Kind string `json:"k"`           // run, resume, end, call, w, o or ret
+	Name string `json:"n,omitempty"` // import, or what resumed the guest
+	Args string `json:"a,omitempty"` // decoded arguments
+	Res  string `json:"r,omitempty"` // decoded result
+	Addr int32  `json:"p,omitempty"` // address of a write
+	Data []byte `json:"d,omitempty"` // bytes of a write or of output
+	Fd   int    `json:"f,omitempty"` // standard file of output
+	Time int64  `json:"t,omitempty"` // nanoseconds taken by an import or a guest entry
+	Err  string `json:"e,omitempty"`
+}
+
+// WithRecorder writes a trace of the bridge to w: every import the guest
+// calls, with its decoded arguments, result and timing, and every time the
+// host runs the guest. Replay runs the guest again from the trace.
+//
+// Writes made by host functions through a View are not recorded.
+func WithRecorder(w io.Writer) Option {
+	return func(b *Bridge) {
+		b.rec = &recorder{w: bufio.NewWriter(w)}
+	}
+}
+
+type recorder struct {
+	w     *bufio.Writer
+	err   error
+	depth int
+	label event
+}
+
+func (r *recorder) emit(ev event) {
+	if r.err != nil {
+		return
+	}
+
+	data, err := json.Marshal(ev)
+	if err == nil {
+		data = append(data, '\n')
+		_, err = r.w.Write(data)
+	}
+	r.err = err
+}
+
+func (r *recorder) flush() error {
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+
+	return r.err
+}
+
+// enter calls the guest export name, recording it as an entry.
+func (r *recorder) enter(b *Bridge, name string, args ...int32) error {
+	ev := r.label
+	r.label = event{}
+	ev.Kind = name
+	if name == "run" {
+		ev.Args = strings.Trim(fmt.Sprint(args), "[]")
+	}
+	r.emit(ev)
+	r.depth++
+	start := time.Now()
+	_, err := b.instance.Call(name, args...)
+	r.depth--
+
+	end := event{Kind: "end", Time: int64(time.Since(start))}
+	if err != nil {
+		end.Err = err.Error()
+	}
+	r.emit(end)
+	if r.depth == 0 {
+		r.flush()
+	}
+
+	return err
+}
+
+// call runs the import name, recording it and what it wrote.
+func (r *recorder) call(b *Bridge, name string, sp int32, imp func(sp int32)) {
+	r.emit(event{Kind: "call", Name: name, Args: b.describeArgs(name, sp)})
+	start := time.Now()
+	imp(sp)
+	r.emit(event{Kind: "ret", Res: b.results[len(b.results)-1], Time: int64(time.Since(start))})
+}
+
+func (r *recorder) write(addr int32, data []byte) {
+	r.emit(event{Kind: "w", Addr: addr, Data: data})
+}
+
+// output records that the guest wrote p to its standard file fd.
+func (r *recorder) output(fd int, p []byte) {
+	r.emit(event{Kind: "o", Fd: fd, Data: p})
+}
+
+// wrote records n bytes written by an import at addr.
+func (b *Bridge) wrote(addr int32, n int) {
+	if b.rec != nil {
+		b.rec.write(addr, b.mem()[addr:addr+int32(n)])
+	}
+}
+
+// wroteSlice records the write of an import to the slice at addr.
+func (b *Bridge) wroteSlice(addr int32) {
+	if b.rec != nil {
+		ptr := b.getInt64(addr)
+		b.wrote(int32(ptr), int(b.getInt64(addr+8)))
+	}
+}
+
+// describeArgs decodes the arguments of the import name for a trace.
+func (b *Bridge) describeArgs(name string, sp int32) string {
+	switch name {
+	case "runtime.wasmExit":
+		return strconv.Itoa(int(b.getInt32(sp + 8)))
+	case "runtime.wasmWrite":
+		return fmt.Sprintf("%d %s", b.getInt64(sp+8), describe(string(b.mem()[b.getInt64(sp+16):][:b.getInt32(sp+24)])))
+	case "runtime.scheduleTimeoutEvent":
+		return strconv.FormatInt(b.getInt64(sp+8), 10) + "ms"
+	case "runtime.clearTimeoutEvent":
+		return strconv.Itoa(int(b.getInt32(sp + 8)))
+	case "syscall/js.stringVal":
+		return describe(b.loadString(sp + 8))
+	case "syscall/js.valueGet":
+		return describe(b.loadValue(sp+8)) + "." + b.loadString(sp+16)
+	case "syscall/js.valueSet":
+		return describe(b.loadValue(sp+8)) + "." + b.loadString(sp+16) + " = " + describe(b.loadValue(sp+32))
+	case "syscall/js.valueDelete":
+		return describe(b.loadValue(sp+8)) + "." + b.loadString(sp+16)
+	case "syscall/js.valueInstanceOf":
+		return describe(b.loadValue(sp+8)) + " instanceof " + describe(b.loadValue(sp+16))
+	case "syscall/js.finalizeRef":
+		return strconv.Itoa(int(b.getUint32(sp + 8)))
+	case "syscall/js.valueIndex":
+		return fmt.Sprintf("%s[%d]", describe(b.loadValue(sp+8)), b.getInt64(sp+16))
+	case "syscall/js.valueSetIndex":
+		return fmt.Sprintf("%s[%d] = %s", describe(b.loadValue(sp+8)), b.getInt64(sp+16), describe(b.loadValue(sp+24)))
+	case "syscall/js.valueCall":
+		return describe(b.loadValue(sp+8)) + "." + b.loadString(sp+16) + describeList(b.loadSliceOfValues(sp+32))
+	case "syscall/js.valueInvoke", "syscall/js.valueNew":
+		return describe(b.loadValue(sp+8)) + describeList(b.loadSliceOfValues(sp+16))
+	case "syscall/js.valueLength", "syscall/js.valuePrepareString", "syscall/js.valueLoadString":
+		return describe(b.loadValue(sp + 8))
+	case "syscall/js.copyBytesToGo":
+		return fmt.Sprintf("%d bytes from %s", b.getInt64(sp+16), describe(b.loadValue(sp+32)))
+	case "syscall/js.copyBytesToJS":
+		return fmt.Sprintf("%d bytes to %s", b.getInt64(sp+24), describe(b.loadValue(sp+8)))
+	}
+
+	return ""
+}
+
+func describeList(vs []interface{}) string {
+	ds := make([]string, len(vs))
+	for i, v := range vs {
+		ds[i] = describe(v)
+	}
+
+	return "(" + strings.Join(ds, ", ") + ")"
+}
+
+// describe returns a short description of a value for a trace.
+func describe(v interface{}) string {
+	if v == undefined {
+		return "undefined"
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		if len(v) > 64 {
+			v = v[:64] + "..."
+		}
+		return strconv.Quote(v)
+	case float64, bool:
+		return fmt.Sprint(v)
+	case *object:
+		if v.name == "" {
+			return "object"
+		}
+		return v.name
+	case *array:
+		return fmt.Sprintf("%s(%d)", v.kind.name(), v.length())
+	case *[]interface{}:
+		return fmt.Sprintf("Array(%d)", len(*v))
+	case *funcWrapper, Func, *Func, Method, *Method:
+		return "func"
+	case *hostObject:
+		return v.v.Type().String()
+	}
+
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32:
+		return fmt.Sprint(v)
+	}
+
+	return fmt.Sprintf("%T", v)
+}
+
+// Replay runs a new instance of m as recorded by WithRecorder in trace. The
+// imports the guest calls, and so the host functions, are not run but answered
+// with what they wrote to the guest's memory when recording. Only
+// runtime.wasmWrite, which the guest's runtime uses for its crash reports, and
+// runtime.wasmExit are run again. Replay returns once the trace is over, or
+// with an error at the first import the guest calls that differs from the trace.
+//
+// What the guest wrote to its standard output and error when recording is
+// written again. opts configure the replaying bridge, e.g. WithStdio for where
+// that output goes, os.Stdout and os.Stderr by default, or WithLogger. Options
+// for what the guest reads, like WithArgs, make no difference as the trace
+// answers for them.
+func Replay(m *Module, trace io.Reader, opts ...Option) error {
+	r := &replayer{dec: json.NewDecoder(trace)}
+	opts = append(opts[:len(opts):len(opts)], func(b *Bridge) { b.replay = r })
+	b, err := newBridge("replay", m, opts)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	for {
+		ev, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// the args and env written for run
+		if ev.Kind == "w" {
+			copy(b.mem()[ev.Addr:], ev.Data)
+			continue
+		}
+
+		if err := r.enter(b, ev); err != nil {
+			return err
+		}
+	}
+}
+
+type replayer struct {
+	dec  *json.Decoder
+	line int
+	err  error
+}
+
+func (r *replayer) next() (event, error) {
+	var ev event
+	r.line++
+	err := r.dec.Decode(&ev)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("trace line %d: %v", r.line, err)
+	}
+	return ev, err
+}
+
+// fail aborts the replay from the import the guest is calling: the guest is
+// aborted and Replay returns the error.
+func (r *replayer) fail(b *Bridge, format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("trace line %d: "+format, append([]interface{}{r.line}, args...)...)
+	}
+	b.abort(r.err)
+}
+
+// enter runs the guest for the entry ev.
+func (r *replayer) enter(b *Bridge, ev event) error {
+	var name string
+	switch ev.Kind {
+	case "run":
+		name = "run"
+	case "resume":
+		name = "resume"
+	default:
+		return fmt.Errorf("trace line %d: expected run or resume, got %s", r.line, ev.Kind)
+	}
+
+	var args []int32
+	if name == "run" {
+		for _, f := range strings.Fields(ev.Args) {
+			arg, err := strconv.ParseInt(f, 10, 32)
+			if err != nil {
+				return fmt.Errorf("trace line %d: bad argument %q", r.line, f)
+			}
+			args = append(args, int32(arg))
+		}
+	}
+
+	_, err := b.instance.Call(name, args...)
+	b.memory = nil
+	if r.err != nil {
+		return r.err
+	}
+
+	end, nerr := r.next()
+	if nerr != nil {
+		return nerr
+	}
+
+	if end.Kind != "end" {
+		return fmt.Errorf("trace line %d: guest returned, trace has %s", r.line, end.Kind)
+	}
+
+	if err != nil && end.Err == "" {
+		return fmt.Errorf("trace line %d: %v", r.line, err)
+	}
+
+	return nil
+}
+
+// call answers the import name from the trace.
+func (r *replayer) call(b *Bridge, name string, sp int32, imp func(sp int32)) {
+	ev, err := r.next()
+	if err != nil {
+		r.fail(b, "guest called %s: %v", name, err)
+	}
+
+	if ev.Kind != "call" || ev.Name != name {
+		r.fail(b, "guest called %s, trace has %s %s", name, ev.Kind, ev.Name)
+	}
+
+	switch name {
+	case "runtime.wasmWrite", "runtime.wasmExit", "debug":
+		imp(sp)
+	}
+
+	for {
+		ev, err := r.next()
+		if err != nil {
+			r.fail(b, "in %s: %v", name, err)
+		}
+
+		switch ev.Kind {
+		case "w":
+			copy(b.mem()[ev.Addr:], ev.Data)
+		case "o":
+			// wasmWrite was run again
+			if name != "runtime.wasmWrite" {
+				b.writeStdout(ev.Fd, ev.Data)
+			}
+		case "run", "resume":
+			if err := r.enter(b, ev); err != nil {
+				r.fail(b, "%v", err)
+			}
+		case "ret":
+			return
+		default:
+			r.fail(b, "in %s, unexpected %s", name, ev.Kind)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package wasm_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestReplay(t *testing.T) {
+	forEngines(t, func(t *testing.T, e wasm.Engine) {
+		var trace bytes.Buffer
+		b := startFunction(t, e, wasm.WithRecorder(&trace))
+		for _, fn := range []string{"multiplier", "getBytes"} {
+			if _, err := b.CallFunc(fn, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(trace.String(), `"n":"syscall/js.valueInvoke"`) {
+			t.Fatalf("trace lacks the call of addProxy:\n%s", trace.String())
+		}
+
+		// the guest logs the sum addProxy returned again
+		m := functionModule(t, e)
+		var stderr bytes.Buffer
+		if err := wasm.Replay(m, bytes.NewReader(trace.Bytes()), wasm.WithStdio(nil, io.Discard, &stderr)); err != nil {
+			t.Errorf("Replay: %v", err)
+		}
+		if !strings.Contains(stderr.String(), "1 + 2 = 3") {
+			t.Errorf("replayed guest wrote %q, want its log of 1 + 2 = 3", stderr.String())
+		}
+
+		// a trace the guest doesn't follow
+		other := strings.Replace(trace.String(), `"n":"syscall/js.valueInvoke"`, `"n":"syscall/js.valueNew"`, 1)
+		if err := wasm.Replay(m, strings.NewReader(other), wasm.WithStdio(nil, io.Discard, io.Discard)); err == nil {
+			t.Error("Replay of a trace the guest doesn't follow succeeded")
+		}
+	})
+}
@@ -0,0 +1,537 @@
+package wasm
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrSnapshotUnsupported is returned by Snapshot and RestoreBridge when the
+// engine of the bridge can't save and restore the guest's state.
+var ErrSnapshotUnsupported = errors.New("wasm: engine can't snapshot the guest, use WazeroEngine")
+
+// snapshot is the state of a bridge saved by Snapshot.
+type snapshot struct {
+	GoVersion string
+	Started   bool // the guest was run, RestoreBridge's Run resumes it
+	Memory    []byte
+	Globals   []uint64
+	ValueIDX  int
+	Values    map[int]int // value table, to nodes
+	RefCounts map[int]int // of modern guests, see finalizeRef
+	IDPool    []int
+	Nodes     []node
+	TimerID   int32
+	Timers    map[int32]time.Duration // time left before the timers expire
+	Cwd       string
+}
+
+type nodeKind int
+
+const (
+	nodeUndefined nodeKind = iota
+	nodeNull
+	nodeBool
+	nodeNumber
+	nodeString
+	nodeObject
+	nodeSlice
+	nodeFunc
+	nodeWrapper
+	nodeBuffer
+	nodeArray
+	nodeView
+)
+
+// node is a value of the value table, or reachable from it. Objects, host
+// functions and the values they reference are saved as a graph, cycles
+// included. The builtin objects and functions of the bridge are saved by their
+// path from the global object, and are those of the new bridge once restored.
+type node struct {
+	Kind   nodeKind
+	Bool   bool
+	Num    float64
+	Str    string         // of strings, name of objects
+	Path   string         // of funcs and objects reachable from the global object
+	Ctor   string         // constructor of objects made by one of the bridge's
+	Props  map[string]int // of objects
+	Items  []int          // of slices
+	Ref    int            // id of wrappers, buffer of arrays and views
+	Array  arrayKind
+	Offset int
+	Length int
+	Data   []byte
+	Detach bool
+}
+
+// Snapshot saves the state of the bridge: the guest's memory and globals, the
+// values held for it, its timers and working directory. RestoreBridge creates
+// bridges from it. Snapshotting a guest that has just registered its functions
+// lets new bridges skip the start of the guest's runtime.
+//
+// The guest must be idle, not waiting in a host function, and
+// have no open files. Host values with no JS counterpart, like class
+// instances, can't be saved. Only wazero bridges can be snapshotted.
+func (b *Bridge) Snapshot() ([]byte, error) {
+	leave, err := b.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	if b.depth > 1 {
+		return nil, errors.New("wasm: can't snapshot while the guest is in a host function")
+	}
+
+	si, ok := b.instance.(Snapshotter)
+	if !ok {
+		return nil, ErrSnapshotUnsupported
+	}
+
+	if len(b.files.fds) > 0 {
+		return nil, errors.New("wasm: can't snapshot a guest with open files")
+	}
+
+	s := snapshot{
+		GoVersion: b.goVersion,
+		Started:   b.started,
+		Memory:    b.instance.Memory(),
+		Globals:   si.Globals(),
+		ValueIDX:  b.valueIDX,
+		Values:    make(map[int]int),
+		Timers:    make(map[int32]time.Duration),
+		Cwd:       b.files.cwd,
+	}
+
+	b.valuesMu.RLock()
+	for id, n := range b.refCounts {
+		if s.RefCounts == nil {
+			s.RefCounts = make(map[int]int)
+		}
+		s.RefCounts[id] = n
+	}
+	s.IDPool = append(s.IDPool, b.idPool...)
+	enc := &snapshotEncoder{s: &s, ids: make(map[interface{}]int), paths: valuePaths(b.valueMap), builtin: builtinPaths()}
+	for id, v := range b.valueMap {
+		n, err := enc.encode(v)
+		if err != nil {
+			b.valuesMu.RUnlock()
+			return nil, fmt.Errorf("wasm: snapshot of value %d: %v", id, err)
+		}
+		s.Values[id] = n
+	}
+	b.valuesMu.RUnlock()
+
+	b.timersMu.Lock()
+	s.TimerID = b.timerID
+	now := b.clock.Now()
+	for id, t := range b.timers {
+		s.Timers[id] = t.when.Sub(now)
+	}
+	b.timersMu.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&s); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// RestoreBridge creates a bridge from m in the state saved by Snapshot. m must
+// be the module the snapshotted bridge was created from, compiled on an engine
+// that can snapshot. Run resumes the guest where it was, instead of starting
+// it, if it was started.
+//
+// The host functions and values the host set with SetFunc and friends aren't
+// saved: they must be set again, at the same paths, before the guest uses them.
+func RestoreBridge(m *Module, snap []byte, opts ...Option) (*Bridge, error) {
+	var s snapshot
+	if err := gob.NewDecoder(bytes.NewReader(snap)).Decode(&s); err != nil {
+		return nil, fmt.Errorf("wasm: reading snapshot: %v", err)
+	}
+
+	if s.GoVersion != m.goVersion {
+		return nil, fmt.Errorf("wasm: snapshot is of a guest built with %q, not %q", s.GoVersion, m.goVersion)
+	}
+
+	b, err := newBridge("", m, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	si, ok := b.instance.(Snapshotter)
+	if !ok {
+		b.Close()
+		return nil, ErrSnapshotUnsupported
+	}
+
+	if err := si.Restore(s.Memory, s.Globals); err != nil {
+		b.Close()
+		return nil, fmt.Errorf("wasm: restoring snapshot: %w", err)
+	}
+
+	dec := &snapshotDecoder{b: b, s: &s, values: make(map[int]interface{}), builtin: valuesByPath(b.valueMap)}
+	values := make(map[int]interface{}, len(s.Values))
+	for id, n := range s.Values {
+		v, err := dec.decode(n)
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("wasm: restoring value %d: %v", id, err)
+		}
+		values[id] = v
+	}
+
+	b.valueMap = values
+	b.valueIDX = s.ValueIDX
+	for id, n := range s.RefCounts {
+		if _, ok := values[id]; !ok {
+			b.Close()
+			return nil, fmt.Errorf("wasm: restoring snapshot: references to missing value %d", id)
+		}
+		b.refCounts[id] = n
+	}
+	b.idPool = append(b.idPool[:0], s.IDPool...)
+	for id, v := range values {
+		// the refs of the values stored by the guest, see storeValue
+		if id >= 8 {
+			b.refs[refKey(v)] = id
+		}
+	}
+
+	b.started = s.Started
+	b.files.cwd = s.Cwd
+	b.timersMu.Lock()
+	b.timerID = s.TimerID
+	for id, d := range s.Timers {
+		if d < 0 {
+			d = 0
+		}
+		b.startTimer(id, d)
+	}
+	b.timersMu.Unlock()
+	return b, nil
+}
+
+// walkValues calls f with the objects and functions reachable from the global
+// object and jsGo through the props of objects, with their paths, "global.fs"
+// for instance. The props are walked in order, so that the paths are stable.
+func walkValues(values map[int]interface{}, f func(path string, v interface{})) {
+	seen := make(map[*object]bool)
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		switch v := v.(type) {
+		case *object:
+			if seen[v] {
+				return
+			}
+			seen[v] = true
+			f(path, v)
+			names := make([]string, 0, len(v.props))
+			for name := range v.props {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				walk(path+"."+name, v.props[name])
+			}
+		case *Func, *Method:
+			f(path, v)
+		}
+	}
+
+	walk("global", values[5])
+	walk("go", values[6])
+}
+
+// valuePaths returns the paths of the objects and functions reachable from
+// the global object. Functions are held by pointer, which identifies them.
+func valuePaths(values map[int]interface{}) map[interface{}]string {
+	paths := make(map[interface{}]string)
+	walkValues(values, func(path string, v interface{}) {
+		if _, ok := paths[v]; !ok {
+			paths[v] = path
+		}
+	})
+
+	return paths
+}
+
+// valuesByPath returns the objects and functions reachable from the global object, by path.
+func valuesByPath(values map[int]interface{}) map[string]interface{} {
+	byPath := make(map[string]interface{})
+	walkValues(values, func(path string, v interface{}) {
+		byPath[path] = v
+	})
+
+	return byPath
+}
+
+// builtinPaths returns the values of a new bridge, by path.
+func builtinPaths() map[string]interface{} {
+	b := &Bridge{clock: realClock{}}
+	b.addValues()
+	return valuesByPath(b.valueMap)
+}
+
+type snapshotEncoder struct {
+	s       *snapshot
+	ids     map[interface{}]int    // nodes of the objects already saved
+	paths   map[interface{}]string // of the bridge's values
+	builtin map[string]interface{} // values of a new bridge
+}
+
+func (e *snapshotEncoder) add(n node) int {
+	e.s.Nodes = append(e.s.Nodes, n)
+	return len(e.s.Nodes) - 1
+}
+
+func (e *snapshotEncoder) encode(v interface{}) (int, error) {
+	if v == undefined {
+		return e.add(node{Kind: nodeUndefined}), nil
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return e.add(node{Kind: nodeNull}), nil
+	case bool:
+		return e.add(node{Kind: nodeBool, Bool: v}), nil
+	case float64:
+		return e.add(node{Kind: nodeNumber, Num: v}), nil
+	case string:
+		return e.add(node{Kind: nodeString, Str: v}), nil
+	}
+
+	if rv := reflect.ValueOf(v); rv.Kind() >= reflect.Int && rv.Kind() <= reflect.Float32 {
+		return e.add(node{Kind: nodeNumber, Num: toFloat(v)}), nil
+	}
+
+	switch v.(type) {
+	case Func, Method:
+		// those of host values, made anew for each get
+		return 0, errors.New("can't save a host function held by value")
+	}
+
+	if id, ok := e.ids[v]; ok {
+		return id, nil
+	}
+
+	// added before what it references, which may reference it back
+	id := e.add(node{})
+	e.ids[v] = id
+	n := node{Path: e.paths[v]}
+	switch v := v.(type) {
+	case *object:
+		n.Kind, n.Str = nodeObject, v.name
+		_, builtin := e.builtin[n.Path].(*object)
+		if v.new != nil && !builtin {
+			return 0, fmt.Errorf("can't save the constructor %s", v.name)
+		}
+
+		// objects made by the bridge's constructors are made again, with
+		// the props that can be saved
+		if ctor := strings.TrimSuffix(v.name, "Inner"); ctor != v.name {
+			if c, ok := e.builtin["global."+ctor].(*object); ok && c.new != nil {
+				n.Ctor = ctor
+			}
+		}
+
+		n.Props = make(map[string]int, len(v.props))
+		for name, pv := range v.props {
+			pn, err := e.encode(pv)
+			if err != nil && n.Ctor != "" {
+				continue
+			}
+			if err != nil {
+				return 0, fmt.Errorf("%s.%s: %v", v.name, name, err)
+			}
+			n.Props[name] = pn
+		}
+	case *Func, *Method:
+		if n.Path == "" {
+			return 0, errors.New("can't save a host function out of reach of the global object")
+		}
+		n.Kind = nodeFunc
+	case *funcWrapper:
+		ref, err := e.encode(v.id)
+		if err != nil {
+			return 0, err
+		}
+		n.Kind, n.Ref = nodeWrapper, ref
+	case *[]interface{}:
+		n.Kind = nodeSlice
+		for _, item := range *v {
+			in, err := e.encode(item)
+			if err != nil {
+				return 0, err
+			}
+			n.Items = append(n.Items, in)
+		}
+	case *arrayBuffer:
+		n.Kind, n.Data, n.Detach = nodeBuffer, v.data, v.detached
+	case *array:
+		ref, err := e.encode(v.buffer)
+		if err != nil {
+			return 0, err
+		}
+		n.Kind, n.Ref, n.Array, n.Offset, n.Length = nodeArray, ref, v.kind, v.offset, v.size/v.kind.size()
+	case *dataView:
+		ref, err := e.encode(v.buffer)
+		if err != nil {
+			return 0, err
+		}
+		n.Kind, n.Ref, n.Offset, n.Length = nodeView, ref, v.offset, v.size
+	default:
+		return 0, fmt.Errorf("can't save %T", v)
+	}
+
+	e.s.Nodes[id] = n
+	return id, nil
+}
+
+type snapshotDecoder struct {
+	b       *Bridge
+	s       *snapshot
+	values  map[int]interface{}    // nodes already restored
+	builtin map[string]interface{} // values of the new bridge
+}
+
+func (d *snapshotDecoder) decode(id int) (interface{}, error) {
+	if v, ok := d.values[id]; ok {
+		return v, nil
+	}
+
+	if id < 0 || id >= len(d.s.Nodes) {
+		return nil, fmt.Errorf("no value %d", id)
+	}
+
+	n := d.s.Nodes[id]
+	switch n.Kind {
+	case nodeUndefined:
+		return undefined, nil
+	case nodeNull:
+		return nil, nil
+	case nodeBool:
+		return n.Bool, nil
+	case nodeNumber:
+		return n.Num, nil
+	case nodeString:
+		return n.Str, nil
+	case nodeObject:
+		o, ok := d.builtin[n.Path].(*object)
+		if !ok && n.Ctor != "" {
+			c, _ := d.builtin["global."+n.Ctor].(*object)
+			if c == nil || c.new == nil {
+				return nil, fmt.Errorf("missing constructor %s", n.Ctor)
+			}
+			o, ok = c.new(nil).(*object)
+			if !ok {
+				return nil, fmt.Errorf("constructor %s failed", n.Ctor)
+			}
+		}
+		if !ok {
+			o = &object{name: n.Str}
+		}
+		if o.props == nil {
+			o.props = make(map[string]interface{}, len(n.Props))
+		}
+
+		d.values[id] = o
+		for name, pn := range n.Props {
+			pv, err := d.decode(pn)
+			if err != nil {
+				return nil, err
+			}
+			o.props[name] = pv
+		}
+		return o, nil
+	case nodeFunc:
+		v, ok := d.builtin[n.Path]
+		if !ok {
+			// set by the host, it must set it again
+			v = d.b.hostFunc(n.Path)
+		}
+		d.values[id] = v
+		return v, nil
+	case nodeWrapper:
+		fw := new(funcWrapper)
+		d.values[id] = fw
+		v, err := d.decode(n.Ref)
+		fw.id = v
+		return fw, err
+	case nodeSlice:
+		items := make([]interface{}, len(n.Items))
+		d.values[id] = &items
+		for i, in := range n.Items {
+			v, err := d.decode(in)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = v
+		}
+		return &items, nil
+	case nodeBuffer:
+		ab := &arrayBuffer{data: n.Data, detached: n.Detach}
+		d.values[id] = ab
+		return ab, nil
+	case nodeArray, nodeView:
+		v, err := d.decode(n.Ref)
+		if err != nil {
+			return nil, err
+		}
+		ab, ok := v.(*arrayBuffer)
+		if !ok {
+			return nil, fmt.Errorf("view over %T", v)
+		}
+
+		size := n.Length
+		if n.Kind == nodeArray {
+			if n.Array < 0 || int(n.Array) >= len(arrayKinds) {
+				return nil, fmt.Errorf("unknown typed array kind %d", n.Array)
+			}
+			size *= n.Array.size()
+		}
+		if n.Offset < 0 || size < 0 || !ab.detached && n.Offset+size > len(ab.data) {
+			return nil, fmt.Errorf("view [%d:%d] out of its buffer", n.Offset, n.Offset+size)
+		}
+
+		var view interface{}
+		if n.Kind == nodeArray {
+			view = newArray(n.Array, ab, n.Offset, n.Length)
+		} else {
+			view = &dataView{buffer: ab, offset: n.Offset, size: n.Length}
+		}
+		d.values[id] = view
+		return view, nil
+	}
+
+	return nil, fmt.Errorf("unknown value kind %d", n.Kind)
+}
+
+// hostFunc returns a function standing for the host function that was at path
+// when the bridge was snapshotted, calling the one found there when called.
+func (b *Bridge) hostFunc(path string) *Method {
+	var m *Method
+	path = strings.TrimPrefix(path, "global.")
+	f := Method(func(this interface{}, args []interface{}) (interface{}, error) {
+		v, err := b.GetValue(path)
+		if err != nil {
+			return nil, err
+		}
+
+		fn, ok := asMethod(v)
+		if v == m || !ok {
+			return nil, fmt.Errorf("wasm: %s wasn't set again after RestoreBridge", path)
+		}
+
+		return fn(this, args)
+	})
+
+	m = &f
+	return m
+}
@@ -0,0 +1,126 @@
+package wasm_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestSnapshot(t *testing.T) {
+	e := wasm.WazeroEngine()
+	b := startFunction(t, e)
+	if _, err := b.CallFunc("multiplier", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := b.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		r, err := wasm.RestoreBridge(functionModule(t, e), snap, wasm.WithStdio(nil, io.Discard, io.Discard))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { r.Close() })
+
+		// the guest's main already ran, it must not call addProxy again
+		proxied := false
+		r.SetFunc("addProxy", func(args []interface{}) (interface{}, error) {
+			proxied = true
+			return r.CallFunc("addition", args)
+		})
+		if err := run(t, r); err != nil {
+			t.Fatal(err)
+		}
+		if proxied {
+			t.Error("restored guest was started again")
+		}
+
+		res, err := r.CallFunc("multiplier", nil)
+		if err != nil || res != float64(10) {
+			t.Fatalf("multiplier() = %v, %v, want 10", res, err)
+		}
+
+		in := []byte("restored")
+		res, err = r.CallFunc("bytes", []interface{}{wasm.FromBytes(in)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := wasm.Bytes(res); err != nil || !bytes.Equal(out, in) {
+			t.Errorf("bytes(%q) = %q, %v", in, out, err)
+		}
+
+		// the builtin functions are those of the new bridge
+		res, err = r.CallFunc("getBytes", nil)
+		if out, berr := wasm.Bytes(res); err != nil || berr != nil || len(out) != 32 {
+			t.Errorf("getBytes() = %v, %v", res, err)
+		}
+	}
+
+	// the snapshotted bridge is left alone
+	if res, err := b.CallFunc("multiplier", nil); err != nil || res != float64(10) {
+		t.Errorf("multiplier() after Snapshot = %v, %v, want 10", res, err)
+	}
+}
+
+func TestSnapshotHostFunc(t *testing.T) {
+	e := wasm.WazeroEngine()
+	b := startFunction(t, e)
+	called := 0
+	ping := wasm.Func(func(args []interface{}) (interface{}, error) {
+		called++
+		return nil, nil
+	})
+	b.SetFunc("host.ping", ping)
+	snap, err := b.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := wasm.RestoreBridge(functionModule(t, e), snap, wasm.WithStdio(nil, io.Discard, io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// host functions stand for the ones set again at their paths
+	v, err := r.GetValue("host.ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func() error {
+		fn, ok := v.(*wasm.Method)
+		if !ok {
+			t.Fatalf("restored host.ping is a %T", v)
+		}
+		_, err := (*fn)(nil, nil)
+		return err
+	}
+
+	if err := call(); err == nil {
+		t.Error("calling a host function that wasn't set again succeeded")
+	}
+
+	r.SetFunc("host.ping", ping)
+	if err := call(); err != nil || called != 1 {
+		t.Errorf("calling host.ping once set again: %v, called %d times", err, called)
+	}
+}
+
+func TestSnapshotUnsupported(t *testing.T) {
+	for _, e := range wasm.Engines() {
+		if e.Name() != "wasmer" {
+			continue
+		}
+
+		b := startFunction(t, e)
+		if _, err := b.Snapshot(); !errors.Is(err, wasm.ErrSnapshotUnsupported) {
+			t.Errorf("Snapshot on wasmer: got %v, want %v", err, wasm.ErrSnapshotUnsupported)
+		}
+	}
+}
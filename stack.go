@@ -0,0 +1,377 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// symbols are what the host needs to read the stack of a guest built with
+// GOOS=js from its memory. Go's wasm linker emits no DWARF: the runtime finds
+// the names, frame sizes and source lines of its functions in its pclntab, in
+// the guest's data, and the module's name section names them for the engines.
+type symbols struct {
+	imports uint32            // number of imported functions, the first indices
+	names   map[uint32]string // function names by index, from the name section
+	pclntab uint32            // address of the runtime's pclntab, 0 if not found
+}
+
+// newSymbols returns the symbols of the wasm bytes. Those missing from the
+// module are left empty.
+func newSymbols(bytes []byte) *symbols {
+	s := &symbols{names: map[uint32]string{}}
+	forImports(section(bytes, 2), func(_, _ string, kind byte) {
+		if kind == 0 {
+			s.imports++
+		}
+	})
+
+	// the function names are the subsection 1 of the name section
+	for p := customSection(bytes, "name"); len(p) > 0; {
+		id := p[0]
+		size, n := uleb128(p[1:])
+		if n == 0 || uint64(len(p)-1-n) < size {
+			break
+		}
+
+		sub := p[1+n : 1+n+int(size)]
+		p = p[1+n+int(size):]
+		if id == 1 {
+			s.readNames(sub)
+		}
+	}
+
+	s.pclntab = findPclntab(section(bytes, 11))
+	return s
+}
+
+// readNames reads the name map of a name subsection.
+func (s *symbols) readNames(p []byte) {
+	count, n := uleb128(p)
+	p = p[n:]
+	for i := uint64(0); n > 0 && i < count; i++ {
+		var idx, l uint64
+		if idx, n = uleb128(p); n == 0 {
+			return
+		}
+		p = p[n:]
+		if l, n = uleb128(p); n == 0 || uint64(len(p)-n) < l {
+			return
+		}
+		s.names[uint32(idx)] = string(p[n : n+int(l)])
+		p = p[n+int(l):]
+	}
+}
+
+// The magic numbers of the pclntab headers of Go 1.2, 1.16, 1.18 and 1.20,
+// which are still those of the latest Go.
+const (
+	go12Pclntab  = 0xfffffffb
+	go116Pclntab = 0xfffffffa
+	go118Pclntab = 0xfffffff0
+	go120Pclntab = 0xfffffff1
+)
+
+// findPclntab returns the address of the pclntab header in the data section
+// body, or 0 if there is none: its magic number followed by two zeros, a
+// minimum instruction size of 1 and 8 bytes pointers, aligned on 8 bytes.
+func findPclntab(body []byte) uint32 {
+	count, n := uleb128(body)
+	p := body[n:]
+	for i := uint64(0); n > 0 && i < count && len(p) > 0; i++ {
+		// active segments of memory 0 at an i32.const offset
+		if p[0] != 0 || len(p) < 2 || p[1] != 0x41 {
+			return 0
+		}
+
+		offset, n := sleb128(p[2:])
+		if n == 0 || len(p) < 3+n || p[2+n] != 0x0b {
+			return 0
+		}
+		p = p[3+n:]
+
+		size, n := uleb128(p)
+		if n == 0 || uint64(len(p)-n) < size {
+			return 0
+		}
+		data := p[n : n+int(size)]
+		p = p[n+int(size):]
+
+		for j := (8 - offset%8) % 8; j+8 <= int64(len(data)); j += 8 {
+			switch binary.LittleEndian.Uint32(data[j:]) {
+			case go12Pclntab, go116Pclntab, go118Pclntab, go120Pclntab:
+				if string(data[j+4:j+8]) == "\x00\x00\x01\x08" {
+					return uint32(offset + j)
+				}
+			}
+		}
+	}
+
+	return 0
+}
+
+// sleb128 decodes a signed LEB128 number from p as uleb128 does.
+func sleb128(p []byte) (int64, int) {
+	var v int64
+	for i, c := range p {
+		if i == 10 {
+			return 0, 0
+		}
+
+		v |= int64(c&0x7f) << (7 * uint(i))
+		if c < 0x80 {
+			if shift := 7 * uint(i+1); shift < 64 && c&0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v, i + 1
+		}
+	}
+
+	return 0, 0
+}
+
+// maxFrames caps the frames read from the guest's stack.
+const maxFrames = 100
+
+// funcValueOffset is what the Go linker adds to the index of a function among
+// those defined by the module to make the PC_F part of its PCs, PC_F<<16|PC_B.
+const funcValueOffset = 0x1000
+
+// stack returns the frames of the guest's goroutine that called the import
+// name with sp, innermost first. The stub of the import is the first. Without
+// a pclntab only the function that called the stub is known, by the name
+// section, where the / of package paths are _.
+func (b *Bridge) stack(name string, sp int32) (frames []Frame) {
+	frames = []Frame{{Func: name}}
+	// the memory is the guest's to trust, a corrupt stack ends the frames
+	defer func() {
+		recover()
+	}()
+
+	mem := b.mem()
+	t := pclntab{mem: mem, base: b.symbols.pclntab}
+	if t.base != 0 {
+		t.init()
+	}
+
+	// the stubs of imports have no frame, sp points at the return PC
+	addr := uint32(sp)
+	for len(frames) < maxFrames {
+		pc := binary.LittleEndian.Uint64(mem[addr:])
+		addr += 8
+		if !t.ok {
+			if name := b.symbols.names[b.symbols.imports+uint32(pc>>16)-funcValueOffset]; name != "" {
+				frames = append(frames, Frame{Func: name})
+			}
+			return frames
+		}
+
+		fn, ok := t.find(pc)
+		if !ok {
+			return frames
+		}
+
+		f := Frame{Func: t.name(fn)}
+		if f.Func == "runtime.goexit" {
+			return frames
+		}
+		// the call is in the block before the one it returns to
+		f.File, f.Line = t.line(fn, pc-1)
+		frames = append(frames, f)
+		size := t.value(fn, t.pcsp(fn), pc)
+		if size < 0 {
+			return frames
+		}
+		addr += uint32(size)
+	}
+
+	return frames
+}
+
+// pclntab reads the pclntab of the Go runtime at base in the guest's memory,
+// the table of the functions of the guest with, for each, the tables of its
+// frame size, file and line by PC.
+type pclntab struct {
+	mem  []byte
+	base uint32
+	ok   bool
+
+	magic     uint32
+	nfunc     uint32
+	indices   bool // the functab has PC_F for the PCs, as in later releases
+	funcnames uint32
+	cutab     uint32
+	filetab   uint32
+	pctab     uint32
+	functab   uint32 // pairs of function PC and offset of its _func
+	funcdata  uint32 // what the offsets of the _funcs are relative to
+}
+
+// init reads the header of the table.
+func (t *pclntab) init() {
+	t.magic = t.u32(t.base)
+	word := func(i uint32) uint32 {
+		return t.base + uint32(t.u64(t.base+8+8*i))
+	}
+
+	t.nfunc = uint32(t.u64(t.base + 8))
+	switch t.magic {
+	case go12Pclntab:
+		t.funcnames, t.pctab, t.functab, t.funcdata = t.base, t.base, t.base+16, t.base
+		// after the functab and the end PC
+		t.filetab = t.base + t.u32(t.functab+t.nfunc*16+8)
+	case go116Pclntab:
+		t.funcnames, t.cutab, t.filetab, t.pctab, t.functab = word(2), word(3), word(4), word(5), word(6)
+		t.funcdata = t.functab
+	case go118Pclntab, go120Pclntab:
+		// the PCs are relative to the text, at 0, the first function has at
+		// least the PC_F funcValueOffset
+		t.funcnames, t.cutab, t.filetab, t.pctab, t.functab = word(3), word(4), word(5), word(6), word(7)
+		t.funcdata = t.functab
+		t.indices = t.u32(t.functab) < 1<<16
+	default:
+		return
+	}
+
+	t.ok = true
+}
+
+func (t *pclntab) u32(addr uint32) uint32 {
+	return binary.LittleEndian.Uint32(t.mem[addr:])
+}
+
+func (t *pclntab) u64(addr uint32) uint64 {
+	return binary.LittleEndian.Uint64(t.mem[addr:])
+}
+
+// entry returns the PC of the function i of the functab, i up to nfunc
+// included for the end of the last one.
+func (t *pclntab) entry(i uint32) uint64 {
+	if t.magic == go118Pclntab || t.magic == go120Pclntab {
+		return t.pc(t.functab + 8*i)
+	}
+
+	return t.u64(t.functab + 16*i)
+}
+
+// pc returns the PC of the entry offset at addr of Go 1.18 and later.
+func (t *pclntab) pc(addr uint32) uint64 {
+	if t.indices {
+		return uint64(t.u32(addr)) << 16
+	}
+	return uint64(t.u32(addr))
+}
+
+// find returns the address of the _func of the function of pc.
+func (t *pclntab) find(pc uint64) (uint32, bool) {
+	if pc < t.entry(0) || pc >= t.entry(t.nfunc) {
+		return 0, false
+	}
+
+	// the last function starting at or before pc
+	lo, hi := uint32(0), t.nfunc
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if t.entry(mid) <= pc {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	if t.magic == go118Pclntab || t.magic == go120Pclntab {
+		return t.funcdata + t.u32(t.functab+8*lo+4), true
+	}
+	return t.funcdata + uint32(t.u64(t.functab+16*lo+8)), true
+}
+
+// field returns the address of the uint32 field i of the _func fn, counting
+// from pcsp.
+func (t *pclntab) field(fn uint32, i uint32) uint32 {
+	// entry is a uintptr before Go 1.18, the nameoff, args and deferreturn
+	// that follow it are 4 bytes
+	if t.magic == go118Pclntab || t.magic == go120Pclntab {
+		return fn + 16 + 4*i
+	}
+	return fn + 20 + 4*i
+}
+
+func (t *pclntab) pcsp(fn uint32) uint32   { return t.u32(t.field(fn, 0)) }
+func (t *pclntab) pcfile(fn uint32) uint32 { return t.u32(t.field(fn, 1)) }
+func (t *pclntab) pcln(fn uint32) uint32   { return t.u32(t.field(fn, 2)) }
+
+// funcEntry returns the PC of the function fn.
+func (t *pclntab) funcEntry(fn uint32) uint64 {
+	if t.magic == go118Pclntab || t.magic == go120Pclntab {
+		return t.pc(fn)
+	}
+	return t.u64(fn)
+}
+
+// name returns the name of the function fn.
+func (t *pclntab) name(fn uint32) string {
+	off := fn + 8
+	if t.magic == go118Pclntab || t.magic == go120Pclntab {
+		off = fn + 4
+	}
+
+	return t.cstring(t.funcnames + t.u32(off))
+}
+
+// cstring returns the string ending with a 0 at addr.
+func (t *pclntab) cstring(addr uint32) string {
+	s := t.mem[addr:]
+	if i := strings.IndexByte(string(s[:min(len(s), 4096)]), 0); i >= 0 {
+		return string(s[:i])
+	}
+	return ""
+}
+
+// value returns the value at pc of the PC-value table at off of the function
+// fn, or -1 if pc is past its end. The table is a sequence of zigzag encoded
+// value deltas, starting from -1, each followed by the number of PCs it holds.
+func (t *pclntab) value(fn, off uint32, pc uint64) int32 {
+	if off == 0 {
+		return -1
+	}
+
+	p := t.mem[t.pctab+off:]
+	val, at := int32(-1), t.funcEntry(fn)
+	for first := true; ; first = false {
+		delta, n := uleb128(p)
+		if n == 0 || (delta == 0 && !first) {
+			return -1
+		}
+		p = p[n:]
+		val += int32(-(delta & 1) ^ (delta >> 1))
+
+		step, n := uleb128(p)
+		if n == 0 {
+			return -1
+		}
+		p = p[n:]
+		at += step
+		if pc < at {
+			return val
+		}
+	}
+}
+
+// line returns the file and line of pc in the function fn.
+func (t *pclntab) line(fn uint32, pc uint64) (string, int) {
+	line := t.value(fn, t.pcln(fn), pc)
+	file := t.value(fn, t.pcfile(fn), pc)
+	if file < 0 {
+		return "", int(line)
+	}
+
+	var name uint32
+	if t.magic == go12Pclntab {
+		name = t.base + t.u32(t.filetab+4*uint32(file))
+	} else {
+		// the file numbers are those of the compilation unit of fn
+		cu := t.u32(t.field(fn, 4))
+		name = t.filetab + t.u32(t.cutab+4*(cu+uint32(file)))
+	}
+
+	return t.cstring(name), int(line)
+}
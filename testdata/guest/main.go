@@ -0,0 +1,236 @@
+//go:build js && wasm
+// +build js,wasm
+
+// Command guest is built by the tests for the features the example guests
+// don't use. It registers its functions on the global object.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"syscall/js"
+	"time"
+	"unsafe"
+)
+
+var borrowed, allocated []byte
+
+// work is a function of its own for the profiles of busy.
+//
+//go:noinline
+func work(n, i int) int {
+	return n*31 + i
+}
+
+func main() {
+	funcs := map[string]func(args []js.Value) interface{}{
+		// sum adds the elements of a typed array
+		"sum": func(args []js.Value) interface{} {
+			sum := 0.0
+			for i := 0; i < args[0].Length(); i++ {
+				sum += args[0].Index(i).Float()
+			}
+			return sum
+		},
+
+		// halves returns a Float64Array of n halves
+		"halves": func(args []js.Value) interface{} {
+			a := js.Global().Get("Float64Array").New(args[0].Int())
+			for i := 0; i < a.Length(); i++ {
+				a.SetIndex(i, float64(i)/2)
+			}
+			return a
+		},
+
+		// shared views an ArrayBuffer as bytes and as int32s
+		"shared": func(args []js.Value) interface{} {
+			buf := js.Global().Get("ArrayBuffer").New(8)
+			bytes := js.Global().Get("Uint8Array").New(buf)
+			ints := js.Global().Get("Int32Array").New(buf)
+			js.CopyBytesToJS(bytes.Call("subarray", 4), []byte{2, 1, 0, 0})
+			return map[string]interface{}{
+				"int":        ints.Index(1),
+				"byteLength": buf.Get("byteLength"),
+				"isInt32":    ints.InstanceOf(js.Global().Get("Int32Array")),
+			}
+		},
+
+		// borrow lets host.fill write to a buffer of args[0] bytes, calls
+		// host.filled and returns what the buffer holds
+		"borrow": func(args []js.Value) interface{} {
+			// on the heap, the stack may move while the host holds its address
+			borrowed = make([]byte, args[0].Int())
+			host := js.Global().Get("host")
+			host.Call("fill", uintptr(unsafe.Pointer(&borrowed[0])), len(borrowed))
+			host.Call("filled")
+			return string(borrowed)
+		},
+
+		// construct returns new args[0](args[1:]...) and whether it is an
+		// instance of args[0], or the name of the error it threw
+		"construct": func(args []js.Value) (res interface{}) {
+			defer func() {
+				if r := recover(); r != nil {
+					err, ok := r.(js.Error)
+					if !ok {
+						panic(r)
+					}
+					res = map[string]interface{}{"thrown": err.Get("name"), "message": err.Get("message")}
+				}
+			}()
+
+			ctor := js.Global().Get(args[0].String())
+			rest := make([]interface{}, len(args)-1)
+			for i, arg := range args[1:] {
+				rest[i] = arg
+			}
+			v := ctor.New(rest...)
+			return map[string]interface{}{"value": v, "instanceOf": v.InstanceOf(ctor)}
+		},
+
+		// sameProp tells whether two reads of the property args[1] of args[0]
+		// give the same value
+		"sameProp": func(args []js.Value) interface{} {
+			name := args[1].String()
+			return args[0].Get(name).Equal(args[0].Get(name))
+		},
+
+		// setProp sets the property args[1] of args[0] to args[2]
+		"setProp": func(args []js.Value) interface{} {
+			args[0].Set(args[1].String(), args[2])
+			return nil
+		},
+
+		// kv uses a KVStore of the host, and returns what it got and its puts
+		"kv": func(args []js.Value) interface{} {
+			kv := js.Global().Get("KVStore").New(args[0])
+			kv.Call("put", "k", args[1])
+			return kv.Call("get", "k").String() + " " + strconv.Itoa(kv.Get("puts").Int())
+		},
+
+		"now": func(args []js.Value) interface{} {
+			return time.Now().UTC().Format(time.RFC3339Nano)
+		},
+
+		"random": func(args []js.Value) interface{} {
+			p := make([]byte, 16)
+			rand.Read(p)
+			return hex.EncodeToString(p)
+		},
+
+		// wake sets woke on the global after args[0] milliseconds
+		"wake": func(args []js.Value) interface{} {
+			d := time.Duration(args[0].Int()) * time.Millisecond
+			time.AfterFunc(d, func() {
+				js.Global().Set("woke", true)
+			})
+			return nil
+		},
+
+		// alloc allocates and touches args[0] MiB
+		"alloc": func(args []js.Value) interface{} {
+			allocated = make([]byte, args[0].Int()<<20)
+			for i := 0; i < len(allocated); i += 4096 {
+				allocated[i] = 1
+			}
+			return len(allocated)
+		},
+
+		// file does the file operation args[0] on the rest of args, and
+		// returns its result, or the errno it failed with
+		"file": func(args []js.Value) interface{} {
+			var res interface{}
+			var err error
+			switch name := args[1].String(); args[0].String() {
+			case "write":
+				err = os.WriteFile(name, []byte(args[2].String()), 0o644)
+			case "append":
+				var f *os.File
+				if f, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0); err == nil {
+					_, err = f.WriteString(args[2].String())
+					f.Close()
+				}
+			case "read":
+				var data []byte
+				data, err = os.ReadFile(name)
+				res = string(data)
+			case "readAt":
+				var f *os.File
+				if f, err = os.Open(name); err == nil {
+					buf := make([]byte, args[3].Int())
+					var n int
+					n, err = f.ReadAt(buf, int64(args[2].Int()))
+					if err == io.EOF {
+						err = nil
+					}
+					res = string(buf[:n])
+					f.Close()
+				}
+			case "stat":
+				var fi os.FileInfo
+				if fi, err = os.Stat(name); err == nil {
+					res = strconv.FormatInt(fi.Size(), 10) + " " + fi.Mode().String()
+				}
+			case "rename":
+				err = os.Rename(name, args[2].String())
+			case "truncate":
+				err = os.Truncate(name, int64(args[2].Int()))
+			}
+
+			if err != nil {
+				var errno syscall.Errno
+				errors.As(err, &errno)
+				return int(errno)
+			}
+			return res
+		},
+
+		// busy works for args[0] milliseconds
+		"busy": func(args []js.Value) interface{} {
+			end := time.Now().Add(time.Duration(args[0].Int()) * time.Millisecond)
+			n := 0
+			for time.Now().Before(end) {
+				for i := 0; i < 1000; i++ {
+					n = work(n, i)
+				}
+			}
+			return n
+		},
+
+		// spin never returns
+		"spin": func(args []js.Value) interface{} {
+			for {
+			}
+		},
+
+		// callOn calls the method args[1] of the global args[0] with the rest of
+		// args
+		"callOn": func(args []js.Value) interface{} {
+			rest := make([]interface{}, len(args)-2)
+			for i, arg := range args[2:] {
+				rest[i] = arg
+			}
+			return js.Global().Get(args[0].String()).Call(args[1].String(), rest...)
+		},
+
+		// double calls myapp.math.double of the host
+		"double": func(args []js.Value) interface{} {
+			return js.Global().Get("myapp").Get("math").Call("double", args[0])
+		},
+	}
+
+	for name, fn := range funcs {
+		fn := fn
+		js.Global().Set(name, js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			return fn(args)
+		}))
+	}
+
+	js.Global().Set("guest", map[string]interface{}{"name": "guest", "version": 2})
+	select {}
+}
@@ -0,0 +1,89 @@
+package wasm
+
+import (
+	"strconv"
+	"time"
+)
+
+// timeout is an expired timer waiting for Run to resume the guest. handled is
+// closed once the guest has seen it.
+type timeout struct {
+	id      int32
+	handled chan struct{}
+}
+
+// timer is a timeout scheduled by the guest.
+type timer struct {
+	stop func() bool
+	when time.Time
+}
+
+// scheduleTimeout arranges for the guest to be resumed after d.
+// This is the host side of setTimeout in wasm_exec.js.
+func (b *Bridge) scheduleTimeout(d time.Duration) int32 {
+	b.timersMu.Lock()
+	defer b.timersMu.Unlock()
+	b.timerID++
+	b.startTimer(b.timerID, d)
+	return b.timerID
+}
+
+// startTimer starts the timer id. Must be called with timersMu held.
+func (b *Bridge) startTimer(id int32, d time.Duration) {
+	stop := b.clock.AfterFunc(d, func() {
+		t := timeout{id: id, handled: make(chan struct{})}
+		select {
+		case b.timeouts <- t:
+			<-t.handled
+		case <-b.done:
+		}
+	})
+
+	b.timers[id] = timer{stop: stop, when: b.clock.Now().Add(d)}
+}
+
+func (b *Bridge) clearTimeout(id int32) {
+	b.timersMu.Lock()
+	defer b.timersMu.Unlock()
+	if t, ok := b.timers[id]; ok {
+		t.stop()
+		delete(b.timers, id)
+	}
+}
+
+func (b *Bridge) timeoutScheduled(id int32) bool {
+	b.timersMu.Lock()
+	defer b.timersMu.Unlock()
+	_, ok := b.timers[id]
+	return ok
+}
+
+func (b *Bridge) stopTimers() {
+	b.timersMu.Lock()
+	defer b.timersMu.Unlock()
+	for id, t := range b.timers {
+		t.stop()
+		delete(b.timers, id)
+	}
+}
+
+// fireTimeout resumes the guest for an expired timeout. Like wasm_exec.js it
+// keeps resuming until the guest has seen the event and cleared the timeout.
+func (b *Bridge) fireTimeout(id int32) {
+	leave, err := b.enter()
+	if err != nil {
+		return
+	}
+	defer leave()
+
+	for first := true; first || b.timeoutScheduled(id); first = false {
+		if b.rec != nil {
+			b.rec.label = event{Name: "timeout", Args: strconv.Itoa(int(id))}
+		}
+
+		if err := b.resume(); err != nil {
+			b.clearTimeout(id)
+			return
+		}
+	}
+}
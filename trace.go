@@ -0,0 +1,168 @@
+package wasm
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HostCall is an import called by the guest, as seen by a Tracer.
+type HostCall struct {
+	Bridge   string // name of the bridge
+	Instance uint64 // instance number of the bridge, see Bridge.Instance
+	Import   string // e.g. syscall/js.valueCall
+	Args     string // decoded arguments, e.g. fs.write(2, Uint8Array(54), 0, 54, null, func)
+}
+
+// Tracer is told about the guest's traffic with the host: the imports behind
+// js.Value's Get, Set, Call, Invoke and New, js.CopyBytesToGo and
+// js.CopyBytesToJS, and the runtime's writes to stdout and stderr.
+//
+// StartCall is called before the import runs. end is called once it returned,
+// with its decoded result if it has one. Imports may nest, when host
+// functions call back into the guest. Calls on one bridge are never concurrent.
+type Tracer interface {
+	StartCall(call HostCall) (end func(result string))
+}
+
+// WithTracer makes the bridge report the guest's calls to the host to t.
+func WithTracer(t Tracer) Option {
+	return func(b *Bridge) {
+		b.tracer = t
+	}
+}
+
+var tracedImports = map[string]bool{
+	"runtime.wasmWrite":        true,
+	"syscall/js.valueGet":      true,
+	"syscall/js.valueSet":      true,
+	"syscall/js.valueCall":     true,
+	"syscall/js.valueInvoke":   true,
+	"syscall/js.valueNew":      true,
+	"syscall/js.copyBytesToGo": true,
+	"syscall/js.copyBytesToJS": true,
+}
+
+// SlogTracer returns a Tracer logging each call once it returned, at level.
+func SlogTracer(logger *slog.Logger, level slog.Level) Tracer {
+	return slogTracer{logger: logger, level: level}
+}
+
+type slogTracer struct {
+	logger *slog.Logger
+	level  slog.Level
+}
+
+func (t slogTracer) StartCall(call HostCall) func(result string) {
+	start := time.Now()
+	return func(result string) {
+		t.logger.LogAttrs(context.Background(), t.level, "host call",
+			slog.String("bridge", call.Bridge),
+			slog.Uint64("instance", call.Instance),
+			slog.String("import", call.Import),
+			slog.String("args", call.Args),
+			slog.String("result", result),
+			slog.Duration("duration", time.Since(start)))
+	}
+}
+
+// Span is a host call traced by a SpanTracer, modelled on OpenTelemetry's.
+// The calls made while serving another one are its children. The calls in one
+// trace are those made in one go by the guest.
+type Span struct {
+	TraceID    uint64
+	SpanID     uint64
+	ParentID   uint64 // 0 for the root of a trace
+	Name       string // the import
+	Start, End time.Time
+	Attributes map[string]string // bridge, instance, args and result
+}
+
+// SpanExporter receives the spans of a SpanTracer as they end.
+type SpanExporter interface {
+	ExportSpan(s Span)
+}
+
+// NewSpanTracer returns a Tracer turning calls into Spans for exp. It may be
+// shared by bridges.
+func NewSpanTracer(exp SpanExporter) Tracer {
+	return &spanTracer{exp: exp, stacks: make(map[uint64][]*Span)}
+}
+
+type spanTracer struct {
+	exp    SpanExporter
+	ids    uint64
+	mu     sync.Mutex
+	stacks map[uint64][]*Span // open spans by bridge instance
+}
+
+func (t *spanTracer) StartCall(call HostCall) func(result string) {
+	s := &Span{
+		SpanID: atomic.AddUint64(&t.ids, 1),
+		Name:   call.Import,
+		Start:  time.Now(),
+		Attributes: map[string]string{
+			"bridge":   call.Bridge,
+			"instance": strconv.FormatUint(call.Instance, 10),
+			"args":     call.Args,
+		},
+	}
+
+	t.mu.Lock()
+	stack := t.stacks[call.Instance]
+	if len(stack) > 0 {
+		parent := stack[len(stack)-1]
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		s.TraceID = s.SpanID
+	}
+	t.stacks[call.Instance] = append(stack, s)
+	t.mu.Unlock()
+
+	return func(result string) {
+		s.End = time.Now()
+		if result != "" {
+			s.Attributes["result"] = result
+		}
+
+		t.mu.Lock()
+		stack := t.stacks[call.Instance]
+		if len(stack) <= 1 {
+			delete(t.stacks, call.Instance)
+		} else {
+			t.stacks[call.Instance] = stack[:len(stack)-1]
+		}
+		t.mu.Unlock()
+		t.exp.ExportSpan(*s)
+	}
+}
+
+// InMemoryExporter is a SpanExporter keeping the spans in memory, for tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+// ExportSpan keeps s.
+func (e *InMemoryExporter) ExportSpan(s Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+// Spans returns the spans exported so far, in the order they ended.
+func (e *InMemoryExporter) Spans() []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Span(nil), e.spans...)
+}
+
+// Reset forgets the spans exported so far.
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
@@ -0,0 +1,175 @@
+package wasm_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strconv"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestSpanTracer(t *testing.T) {
+	var exp wasm.InMemoryExporter
+	tracer := wasm.NewSpanTracer(&exp)
+	m := functionModule(t, wasm.WazeroEngine())
+
+	// two bridges of the same name sharing the tracer, one calling the other
+	// while its own span is open
+	other, err := m.NewBridge("same", wasm.WithTracer(tracer), wasm.WithStdio(nil, io.Discard, io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { other.Close() })
+	other.SetFunc("addProxy", func(args []interface{}) (interface{}, error) {
+		return other.CallFunc("addition", args)
+	})
+	if err := run(t, other); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := m.NewBridge("same", wasm.WithTracer(tracer), wasm.WithStdio(nil, io.Discard, io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	b.SetFunc("addProxy", func(args []interface{}) (interface{}, error) {
+		if _, err := other.CallFunc("multiplier", nil); err != nil {
+			return nil, err
+		}
+		return b.CallFunc("addition", args)
+	})
+	exp.Reset()
+	if err := run(t, b); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exp.Spans()
+	if len(spans) == 0 {
+		t.Fatal("no spans")
+	}
+
+	byID := map[uint64]wasm.Span{}
+	for _, s := range spans {
+		byID[s.SpanID] = s
+	}
+
+	instance := func(s wasm.Span) uint64 {
+		n, _ := strconv.ParseUint(s.Attributes["instance"], 10, 64)
+		return n
+	}
+
+	var invoke *wasm.Span
+	nested := 0
+	for i, s := range spans {
+		if s.Attributes["bridge"] != "same" {
+			t.Errorf("span %s of bridge %q", s.Name, s.Attributes["bridge"])
+		}
+
+		if s.ParentID == 0 {
+			if s.TraceID != s.SpanID {
+				t.Errorf("root span %s has trace %d", s.Name, s.TraceID)
+			}
+			if s.Name == "syscall/js.valueInvoke" && instance(s) == b.Instance() {
+				invoke = &spans[i]
+			}
+			continue
+		}
+
+		parent, ok := byID[s.ParentID]
+		if !ok {
+			t.Errorf("span %s has unknown parent %d", s.Name, s.ParentID)
+			continue
+		}
+
+		if instance(parent) != instance(s) {
+			t.Errorf("span %s of instance %d has a parent of instance %d", s.Name, instance(s), instance(parent))
+		}
+		if s.TraceID != parent.TraceID {
+			t.Errorf("span %s is in trace %d, its parent in %d", s.Name, s.TraceID, parent.TraceID)
+		}
+		if instance(s) == b.Instance() {
+			nested++
+		}
+	}
+
+	if invoke == nil {
+		t.Fatal("no span for the call of addProxy")
+	}
+
+	// the other bridge's calls made from addProxy are traces of their own
+	others := 0
+	for _, s := range spans {
+		if instance(s) == other.Instance() {
+			others++
+			if s.Start.Before(invoke.Start) || s.End.After(invoke.End) {
+				t.Errorf("span %s of the other bridge outside of addProxy", s.Name)
+			}
+		}
+	}
+
+	if others == 0 || nested == 0 {
+		t.Errorf("got %d spans of the other bridge and %d nested ones, want some", others, nested)
+	}
+}
+
+func TestSlogTracer(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	m := functionModule(t, wasm.WazeroEngine())
+	b, err := m.NewBridge("slog", wasm.WithTracer(wasm.SlogTracer(logger, slog.LevelWarn)), wasm.WithStdio(nil, io.Discard, io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	// addProxy calls back into the guest, whose imports return values of
+	// their own before addProxy does
+	b.SetFunc("addProxy", func(args []interface{}) (interface{}, error) {
+		if _, err := b.CallFunc("addition", args); err != nil {
+			return nil, err
+		}
+		return 42, nil
+	})
+	if err := run(t, b); err != nil {
+		t.Fatal(err)
+	}
+
+	type record struct {
+		Level    string
+		Msg      string
+		Bridge   string
+		Instance uint64
+		Import   string
+		Args     string
+		Result   string
+		Duration *int64
+	}
+
+	var invoke *record
+	calls := 0
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var r record
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+
+		calls++
+		if r.Level != "WARN" || r.Msg != "host call" || r.Bridge != "slog" || r.Instance != b.Instance() || r.Import == "" || r.Duration == nil {
+			t.Errorf("got record %+v", r)
+		}
+		if r.Import == "syscall/js.valueInvoke" {
+			invoke = &r
+		}
+	}
+
+	if invoke == nil {
+		t.Fatalf("no record for the call of addProxy in %d", calls)
+	}
+	if invoke.Args != "func(1, 2)" || invoke.Result != "42" {
+		t.Errorf("got addProxy%s = %s, want addProxy(1, 2) = 42", invoke.Args, invoke.Result)
+	}
+}
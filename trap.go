@@ -0,0 +1,134 @@
+package wasm
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// GuestTrap is the error returned by Run and CallFunc when the guest crashed:
+// it trapped, a host function it called panicked, or its runtime panicked and
+// exited. The bridge can't be used afterwards.
+//
+// The frames of a runtime panic are those of its crash report. Those of a
+// panicking host function or import, on any engine, are read from the guest's
+// memory: its goroutine's stack, named from the module's name section, with
+// the frame sizes and source lines of the Go runtime's pclntab. Inlined calls
+// are part of their caller. The engines don't say where the guest's own code
+// trapped, those traps have no frames, but Go guests report their faults as
+// runtime panics.
+type GuestTrap struct {
+	Bridge string  // name of the bridge
+	Reason string  // e.g. unreachable, or panic: runtime error: index out of range
+	Frames []Frame // the guest's stack, innermost first, if known
+	Err    error   // the engine's error, nil when the guest's runtime exited
+}
+
+// Frame is a function on the guest's stack.
+type Frame struct {
+	Func string // e.g. main.handler
+	File string // empty when unknown
+	Line int
+}
+
+func (t *GuestTrap) Error() string {
+	return "wasm: guest " + t.Bridge + " crashed: " + t.Reason
+}
+
+func (t *GuestTrap) Unwrap() error {
+	return t.Err
+}
+
+// Err returns the error the guest crashed with, if it did: a *GuestTrap, or an
+// error wrapping ErrInterrupted or ErrOutOfMemory. Run returns once the guest
+// crashed.
+func (b *Bridge) Err() error {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+	return b.crash
+}
+
+// crashed returns the error of a call into the guest that returned err, once
+// the guest returned. Traps are given the name of the bridge, and a runtime
+// that panicked and exited during the call is reported as a trap.
+func (b *Bridge) crashed(err error) error {
+	if err == nil && b.trap != nil {
+		err = b.trap
+	}
+	if err == nil {
+		return nil
+	}
+
+	// the guest's runtime can't be resumed after a trap
+	b.stateMu.Lock()
+	b.exited = true
+	b.crash = err
+	if b.cancF != nil {
+		b.cancF()
+	}
+	b.stateMu.Unlock()
+	var trap *GuestTrap
+	if errors.As(err, &trap) {
+		trap.Bridge = b.name
+	}
+
+	return err
+}
+
+// maxStderr is the size of the tail of the guest's stderr kept for its crash reports.
+const maxStderr = 16 << 10
+
+// wroteStderr keeps the tail of what the guest wrote to stderr.
+func (b *Bridge) wroteStderr(p []byte) {
+	b.errTail = append(b.errTail, p...)
+	if len(b.errTail) > maxStderr {
+		b.errTail = append(b.errTail[:0], b.errTail[len(b.errTail)-maxStderr:]...)
+	}
+}
+
+// panicTrap returns the trap for the crash report of the Go runtime at the
+// end of the guest's stderr, or nil if there is none. The runtime symbolises
+// its frames itself, with their file and line.
+func (b *Bridge) panicTrap() *GuestTrap {
+	out := "\n" + string(b.errTail)
+	start := strings.LastIndex(out, "\npanic: ")
+	if fatal := strings.LastIndex(out, "\nfatal error: "); fatal > start {
+		start = fatal
+	}
+	if start < 0 {
+		return nil
+	}
+
+	lines := strings.Split(out[start+1:], "\n")
+	trap := &GuestTrap{Bridge: b.name, Reason: lines[0]}
+	for i, l := range lines {
+		if !strings.HasPrefix(l, "goroutine ") {
+			continue
+		}
+
+		// the first goroutine is the one that crashed: pairs of function and
+		// file:line +pc lines, up to a blank line.
+		for l := lines[i+1:]; len(l) > 1 && l[0] != ""; l = l[2:] {
+			if strings.HasPrefix(l[0], "created by ") {
+				break
+			}
+
+			f := Frame{Func: l[0]}
+			if strings.HasSuffix(f.Func, ")") {
+				f.Func = f.Func[:strings.LastIndexByte(f.Func, '(')]
+			}
+			pos := strings.TrimSpace(l[1])
+			if i := strings.Index(pos, " +0x"); i >= 0 {
+				pos = pos[:i]
+			}
+			if i := strings.LastIndexByte(pos, ':'); i >= 0 {
+				f.File = pos[:i]
+				f.Line, _ = strconv.Atoi(pos[i+1:])
+			}
+			trap.Frames = append(trap.Frames, f)
+		}
+		break
+	}
+
+	return trap
+}
@@ -0,0 +1,87 @@
+package wasm_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestTrapFrames(t *testing.T) {
+	// a guest of each layout of the runtime's pclntab: Go 1.2 (Go 1.13's),
+	// 1.16, 1.18 and the latest, which is 1.20's with function indices for
+	// PCs. Reading them doesn't depend on the engine, wasmer only runs the
+	// first.
+	guests := []struct {
+		name    string
+		module  func(t testing.TB, e wasm.Engine) *wasm.Module
+		engines []wasm.Engine
+	}{
+		{"go1.13", built(legacyGo), wasm.Engines()},
+		{"go1.16", built("go1.16.15"), []wasm.Engine{wasm.WazeroEngine()}},
+		{"go1.18", built("go1.18.10"), []wasm.Engine{wasm.WazeroEngine()}},
+		{"latest", built(""), []wasm.Engine{wasm.WazeroEngine()}},
+	}
+
+	for _, g := range guests {
+		for _, e := range g.engines {
+			t.Run(g.name+"/"+e.Name(), func(t *testing.T) {
+				m := g.module(t, e)
+				for _, callBack := range []bool{false, true} {
+					b := newBridge(t, m)
+					b.SetFunc("addProxy", func(args []interface{}) (interface{}, error) {
+						// the guest's stack may move while it runs
+						if callBack {
+							b.CallFunc("addition", args)
+						}
+						panic("no proxy")
+					})
+
+					var trap *wasm.GuestTrap
+					if err := run(t, b); !errors.As(err, &trap) {
+						t.Fatalf("got %v, want a *GuestTrap", err)
+					}
+
+					checkFrames(t, trap.Frames)
+				}
+			})
+		}
+	}
+}
+
+// built returns a func compiling examples/function-wasm built with the Go
+// release version.
+func built(version string) func(t testing.TB, e wasm.Engine) *wasm.Module {
+	return func(t testing.TB, e wasm.Engine) *wasm.Module {
+		m, err := wasm.NewModule(e, buildGuest(t, "examples/function-wasm", version))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(m.Close)
+		return m
+	}
+}
+
+// checkFrames checks frames are those of the call of addProxy by the main of
+// examples/function-wasm.
+func checkFrames(t *testing.T, frames []wasm.Frame) {
+	t.Helper()
+	want := []wasm.Frame{
+		{Func: "syscall/js.valueInvoke"},
+		{Func: "syscall/js.Value.Invoke", File: "syscall/js/js.go"},
+		{Func: "main.main", File: "examples/function-wasm/main.go", Line: 58},
+		{Func: "runtime.main", File: "runtime/proc.go"},
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("got frames %+v, want %+v", frames, want)
+	}
+
+	for i, f := range frames {
+		w := want[i]
+		if f.Func != w.Func || !strings.HasSuffix(f.File, w.File) || (w.Line != 0 && f.Line != w.Line) || (w.File != "" && f.Line == 0) {
+			t.Errorf("got frame %d %+v, want %+v", i, f, w)
+		}
+	}
+}
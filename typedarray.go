@@ -0,0 +1,697 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// arrayKind is the element type of a typed array.
+type arrayKind int
+
+const (
+	kindInt8 arrayKind = iota
+	kindUint8
+	kindUint8Clamped
+	kindInt16
+	kindUint16
+	kindInt32
+	kindUint32
+	kindFloat32
+	kindFloat64
+)
+
+var arrayKinds = []struct {
+	name string
+	size int
+}{
+	kindInt8:         {"Int8Array", 1},
+	kindUint8:        {"Uint8Array", 1},
+	kindUint8Clamped: {"Uint8ClampedArray", 1},
+	kindInt16:        {"Int16Array", 2},
+	kindUint16:       {"Uint16Array", 2},
+	kindInt32:        {"Int32Array", 4},
+	kindUint32:       {"Uint32Array", 4},
+	kindFloat32:      {"Float32Array", 4},
+	kindFloat64:      {"Float64Array", 8},
+}
+
+func (k arrayKind) name() string { return arrayKinds[k].name }
+func (k arrayKind) size() int    { return arrayKinds[k].size }
+
+// arrayBuffer is the backing store shared by typed arrays and data views.
+type arrayBuffer struct {
+	data     []byte
+	detached bool
+	checked  bool // using the detached buffer is an error, see Lend
+	methods  methods
+}
+
+// detach releases the buffer. Views over a detached buffer have no bytes.
+func (ab *arrayBuffer) detach() {
+	ab.data = nil
+	ab.detached = true
+}
+
+// released returns ErrBufferReleased if the buffer is checked and detached.
+func (ab *arrayBuffer) released() error {
+	if ab.checked && ab.detached {
+		return ErrBufferReleased
+	}
+
+	return nil
+}
+
+// checkReleased panics, aborting the guest, if v is a view over a checked
+// buffer that was detached.
+func checkReleased(v interface{}) {
+	if ab := bufferOf(v); ab != nil {
+		if err := ab.released(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// bufferOf returns the buffer of a typed array, DataView or ArrayBuffer, or nil.
+func bufferOf(v interface{}) *arrayBuffer {
+	switch v := v.(type) {
+	case *arrayBuffer:
+		return v
+	case *array:
+		return v.buffer
+	case *dataView:
+		return v.buffer
+	}
+
+	return nil
+}
+
+func (ab *arrayBuffer) get(prop string) (interface{}, bool) {
+	switch prop {
+	case "byteLength":
+		return len(ab.data), true
+	case "slice":
+		return ab.methods.get(prop, ab.method), true
+	}
+
+	return nil, false
+}
+
+// method makes the method prop of the buffer, slice being the only one.
+func (ab *arrayBuffer) method(prop string) Func {
+	return func(args []interface{}) (interface{}, error) {
+		if err := ab.released(); err != nil {
+			return nil, err
+		}
+
+		start, end := sliceRange(args, len(ab.data))
+		data := make([]byte, end-start)
+		copy(data, ab.data[start:end])
+		return &arrayBuffer{data: data}, nil
+	}
+}
+
+// array is a typed array view over size bytes of an arrayBuffer.
+type array struct {
+	kind    arrayKind
+	buffer  *arrayBuffer
+	offset  int
+	size    int
+	methods methods
+}
+
+func newArray(kind arrayKind, buffer *arrayBuffer, offset, length int) *array {
+	return &array{
+		kind:   kind,
+		buffer: buffer,
+		offset: offset,
+		size:   length * kind.size(),
+	}
+}
+
+// bytes returns the viewed region of the buffer, which shares its memory, or
+// nil once the buffer is detached.
+func (a *array) bytes() []byte {
+	if a.buffer.detached {
+		return nil
+	}
+
+	return a.buffer.data[a.offset : a.offset+a.size]
+}
+
+func (a *array) length() int {
+	return len(a.bytes()) / a.kind.size()
+}
+
+// index returns the element i, NaN if it is out of bounds.
+func (a *array) index(i int) float64 {
+	s := a.kind.size()
+	buf := a.bytes()
+	if i < 0 || i*s+s > len(buf) {
+		return math.NaN()
+	}
+
+	p := buf[i*s : i*s+s]
+	switch a.kind {
+	case kindInt8:
+		return float64(int8(p[0]))
+	case kindUint8, kindUint8Clamped:
+		return float64(p[0])
+	case kindInt16:
+		return float64(int16(binary.LittleEndian.Uint16(p)))
+	case kindUint16:
+		return float64(binary.LittleEndian.Uint16(p))
+	case kindInt32:
+		return float64(int32(binary.LittleEndian.Uint32(p)))
+	case kindUint32:
+		return float64(binary.LittleEndian.Uint32(p))
+	case kindFloat32:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(p)))
+	default:
+		return math.Float64frombits(binary.LittleEndian.Uint64(p))
+	}
+}
+
+// setIndex sets the element i, if it is in bounds.
+func (a *array) setIndex(i int, v float64) {
+	s := a.kind.size()
+	buf := a.bytes()
+	if i < 0 || i*s+s > len(buf) {
+		return
+	}
+
+	p := buf[i*s : i*s+s]
+	switch a.kind {
+	case kindInt8, kindUint8:
+		p[0] = byte(toInt(v))
+	case kindUint8Clamped:
+		switch {
+		case math.IsNaN(v) || v < 0:
+			p[0] = 0
+		case v > 255:
+			p[0] = 255
+		default:
+			p[0] = byte(math.RoundToEven(v))
+		}
+	case kindInt16, kindUint16:
+		binary.LittleEndian.PutUint16(p, uint16(toInt(v)))
+	case kindInt32, kindUint32:
+		binary.LittleEndian.PutUint32(p, uint32(toInt(v)))
+	case kindFloat32:
+		binary.LittleEndian.PutUint32(p, math.Float32bits(float32(v)))
+	default:
+		binary.LittleEndian.PutUint64(p, math.Float64bits(v))
+	}
+}
+
+func (a *array) get(prop string) (interface{}, bool) {
+	switch prop {
+	case "length":
+		return a.length(), true
+	case "byteLength":
+		return len(a.bytes()), true
+	case "byteOffset":
+		if a.buffer.detached {
+			return 0, true
+		}
+		return a.offset, true
+	case "buffer":
+		return a.buffer, true
+	case "BYTES_PER_ELEMENT":
+		return a.kind.size(), true
+	case "subarray", "slice", "set", "fill":
+		return a.methods.get(prop, a.method), true
+	}
+
+	return nil, false
+}
+
+// method makes the method prop of the typed array.
+func (a *array) method(prop string) Func {
+	switch prop {
+	case "subarray":
+		return func(args []interface{}) (interface{}, error) {
+			if err := a.buffer.released(); err != nil {
+				return nil, err
+			}
+
+			start, end := sliceRange(args, a.length())
+			return newArray(a.kind, a.buffer, a.offset+start*a.kind.size(), end-start), nil
+		}
+	case "slice":
+		return func(args []interface{}) (interface{}, error) {
+			if err := a.buffer.released(); err != nil {
+				return nil, err
+			}
+
+			start, end := sliceRange(args, a.length())
+			s := a.kind.size()
+			buffer := &arrayBuffer{data: make([]byte, (end-start)*s)}
+			copy(buffer.data, a.bytes()[start*s:end*s])
+			return newArray(a.kind, buffer, 0, end-start), nil
+		}
+	case "set":
+		return func(args []interface{}) (interface{}, error) {
+			if err := a.buffer.released(); err != nil {
+				return nil, err
+			}
+
+			offset := 0
+			if len(args) > 1 {
+				offset = int(toFloat(args[1]))
+			}
+
+			var src []float64
+			var err error
+			if len(args) > 0 {
+				src, err = arrayValues(args[0])
+			}
+			if err != nil || len(args) == 0 {
+				return nil, typeErrorf("%s.set: invalid source", a.kind.name())
+			}
+
+			if offset < 0 || offset+len(src) > a.length() {
+				return nil, rangeErrorf("%s.set: offset is out of bounds", a.kind.name())
+			}
+
+			for i, v := range src {
+				a.setIndex(offset+i, v)
+			}
+			return nil, nil
+		}
+	case "fill":
+		return func(args []interface{}) (interface{}, error) {
+			if err := a.buffer.released(); err != nil {
+				return nil, err
+			}
+
+			var v float64
+			if len(args) > 0 {
+				v = toFloat(args[0])
+			}
+
+			var rest []interface{}
+			if len(args) > 1 {
+				rest = args[1:]
+			}
+			start, end := sliceRange(rest, a.length())
+			for i := start; i < end; i++ {
+				a.setIndex(i, v)
+			}
+			return a, nil
+		}
+	}
+
+	return nil
+}
+
+// dataView is a JS DataView over size bytes of an arrayBuffer.
+type dataView struct {
+	buffer  *arrayBuffer
+	offset  int
+	size    int
+	methods methods
+}
+
+// bytes returns the viewed region of the buffer, nil once it is detached.
+func (dv *dataView) bytes() []byte {
+	if dv.buffer.detached {
+		return nil
+	}
+
+	return dv.buffer.data[dv.offset : dv.offset+dv.size]
+}
+
+func (dv *dataView) get(prop string) (interface{}, bool) {
+	switch prop {
+	case "byteLength":
+		return len(dv.bytes()), true
+	case "byteOffset":
+		if dv.buffer.detached {
+			return 0, true
+		}
+		return dv.offset, true
+	case "buffer":
+		return dv.buffer, true
+	}
+
+	var kind arrayKind
+	switch prop {
+	case "getInt8", "setInt8":
+		kind = kindInt8
+	case "getUint8", "setUint8":
+		kind = kindUint8
+	case "getInt16", "setInt16":
+		kind = kindInt16
+	case "getUint16", "setUint16":
+		kind = kindUint16
+	case "getInt32", "setInt32":
+		kind = kindInt32
+	case "getUint32", "setUint32":
+		kind = kindUint32
+	case "getFloat32", "setFloat32":
+		kind = kindFloat32
+	case "getFloat64", "setFloat64":
+		kind = kindFloat64
+	default:
+		return nil, false
+	}
+
+	return dv.methods.get(prop, func(prop string) Func { return dv.accessor(prop, kind) }), true
+}
+
+// accessor makes the getter or setter prop of the DataView for elements of kind.
+func (dv *dataView) accessor(prop string, kind arrayKind) Func {
+	setter := prop[0] == 's'
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) < 1 {
+			return nil, typeErrorf("DataView.%s: missing byteOffset", prop)
+		}
+
+		if err := dv.buffer.released(); err != nil {
+			return nil, err
+		}
+
+		buf := dv.bytes()
+		offset := int(toFloat(args[0]))
+		s := kind.size()
+		if offset < 0 || offset+s > len(buf) {
+			return nil, rangeErrorf("DataView.%s: offset is outside the bounds of the DataView", prop)
+		}
+
+		// DataView defaults to big endian unless littleEndian is passed as true.
+		littleEndian := false
+		leArg := 1
+		if setter {
+			leArg = 2
+		}
+		if len(args) > leArg {
+			littleEndian = args[leArg] == true
+		}
+
+		// a one element typed array over a scratch buffer does the encoding,
+		// we only need to fix the byte order for big endian access.
+		tmp := make([]byte, s)
+		elem := newArray(kind, &arrayBuffer{data: tmp}, 0, 1)
+		if !setter {
+			copy(tmp, buf[offset:offset+s])
+			if !littleEndian {
+				reverse(tmp)
+			}
+			return elem.index(0), nil
+		}
+
+		var v float64
+		if len(args) > 1 {
+			v = toFloat(args[1])
+		}
+		elem.setIndex(0, v)
+		if !littleEndian {
+			reverse(tmp)
+		}
+		copy(buf[offset:offset+s], tmp)
+		return nil, nil
+	}
+}
+
+func reverse(p []byte) {
+	for i, j := 0, len(p)-1; i < j; i, j = i+1, j-1 {
+		p[i], p[j] = p[j], p[i]
+	}
+}
+
+func arrayBufferObject() *object {
+	return &object{
+		name: "ArrayBuffer",
+		new: func(args []interface{}) interface{} {
+			l := 0
+			if len(args) > 0 {
+				var ok bool
+				if l, ok = toIndex(args[0]); !ok {
+					return rangeErrorf("ArrayBuffer: invalid array buffer length")
+				}
+			}
+			return &arrayBuffer{data: make([]byte, l)}
+		},
+	}
+}
+
+func dataViewObject() *object {
+	return &object{
+		name: "DataView",
+		new: func(args []interface{}) interface{} {
+			var buffer *arrayBuffer
+			if len(args) > 0 {
+				buffer, _ = args[0].(*arrayBuffer)
+			}
+			if buffer == nil {
+				return typeErrorf("DataView: first argument must be an ArrayBuffer")
+			}
+
+			offset, ok := 0, true
+			if len(args) > 1 && args[1] != undefined {
+				offset, ok = toIndex(args[1])
+			}
+			l := len(buffer.data) - offset
+			if ok && len(args) > 2 && args[2] != undefined {
+				l, ok = toIndex(args[2])
+			}
+			if !ok || offset+l > len(buffer.data) || l < 0 {
+				return rangeErrorf("DataView: invalid DataView length")
+			}
+
+			return &dataView{buffer: buffer, offset: offset, size: l}
+		},
+	}
+}
+
+func typedArrayObject(kind arrayKind) *object {
+	return &object{
+		name: kind.name(),
+		new: func(args []interface{}) interface{} {
+			if len(args) == 0 {
+				return newArray(kind, &arrayBuffer{}, 0, 0)
+			}
+
+			switch v := args[0].(type) {
+			case float64:
+				l, ok := toIndex(v)
+				if !ok {
+					return rangeErrorf("%s: invalid typed array length: %v", kind.name(), v)
+				}
+				return newArray(kind, &arrayBuffer{data: make([]byte, l*kind.size())}, 0, l)
+			case *arrayBuffer:
+				offset, ok := 0, true
+				if len(args) > 1 && args[1] != undefined {
+					offset, ok = toIndex(args[1])
+				}
+				if !ok || offset%kind.size() != 0 {
+					return rangeErrorf("%s: start offset should be a multiple of %d", kind.name(), kind.size())
+				}
+
+				l := (len(v.data) - offset) / kind.size()
+				if len(args) > 2 && args[2] != undefined {
+					l, ok = toIndex(args[2])
+				}
+				if !ok || l < 0 || offset+l*kind.size() > len(v.data) {
+					return rangeErrorf("%s: invalid typed array length", kind.name())
+				}
+				return newArray(kind, v, offset, l)
+			}
+
+			vals, err := arrayValues(args[0])
+			if err != nil {
+				return typeErrorf("%s: %v", kind.name(), err)
+			}
+
+			a := newArray(kind, &arrayBuffer{data: make([]byte, len(vals)*kind.size())}, 0, len(vals))
+			for i, v := range vals {
+				a.setIndex(i, v)
+			}
+			return a
+		},
+	}
+}
+
+// instanceOf tells whether v was made by the constructor ctor, as far as the
+// host's values tell.
+func instanceOf(v, ctor interface{}) bool {
+	c, ok := ctor.(*object)
+	if !ok || c.new == nil {
+		return false
+	}
+
+	switch v := v.(type) {
+	case *array:
+		return v.kind.name() == c.name
+	case *arrayBuffer:
+		return c.name == "ArrayBuffer"
+	case *dataView:
+		return c.name == "DataView"
+	case *[]interface{}:
+		return c.name == "Array" || c.name == "Object"
+	case *object:
+		return c.name == "Object" || v.name == c.name+"Inner"
+	case *hostObject:
+		return c.name == "Object" || v.class == c
+	}
+
+	return false
+}
+
+// arrayValues returns the elements of a typed array or a JS array as numbers.
+func arrayValues(v interface{}) ([]float64, error) {
+	switch v := v.(type) {
+	case *array:
+		vals := make([]float64, v.length())
+		for i := range vals {
+			vals[i] = v.index(i)
+		}
+		return vals, nil
+	case *[]interface{}:
+		vals := make([]float64, len(*v))
+		for i, e := range *v {
+			vals[i] = toFloat(e)
+		}
+		return vals, nil
+	}
+
+	return nil, fmt.Errorf("expected array, got %T", v)
+}
+
+// sliceRange resolves the optional (start, end) arguments of slice, subarray and
+// fill against a length of l, including negative offsets counting from the end.
+func sliceRange(args []interface{}, l int) (start, end int) {
+	rel := func(i int, def int) int {
+		if len(args) <= i || args[i] == undefined {
+			return def
+		}
+
+		n := int(toFloat(args[i]))
+		if n < 0 {
+			n += l
+		}
+		switch {
+		case n < 0:
+			return 0
+		case n > l:
+			return l
+		}
+		return n
+	}
+
+	start, end = rel(0, 0), rel(1, l)
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+func toFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case nil:
+		return 0
+	}
+
+	return math.NaN()
+}
+
+// toInt converts v the way JS does when storing into an integer typed array.
+func toInt(v float64) int64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0
+	}
+
+	return int64(math.Trunc(math.Mod(v, 1<<32)))
+}
+
+// maxIndex bounds lengths and offsets, guest memory being 32 bit.
+const maxIndex = 1<<32 - 1
+
+// toIndex converts a length or offset the way JS does, false if it is negative
+// or too large.
+func toIndex(v interface{}) (int, bool) {
+	f := toFloat(v)
+	if math.IsNaN(f) {
+		return 0, true
+	}
+
+	f = math.Trunc(f)
+	if f < 0 || f > maxIndex {
+		return 0, false
+	}
+
+	return int(f), true
+}
+
+// byteView returns the bytes viewed by a typed array, DataView or ArrayBuffer.
+func byteView(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case *array:
+		return v.bytes(), !v.buffer.detached
+	case *dataView:
+		return v.bytes(), !v.buffer.detached
+	case *arrayBuffer:
+		return v.data, !v.detached
+	}
+
+	return nil, false
+}
+
+// methods caches the functions a value hands out as properties, so that every
+// read of a method gives the guest the same function, and the same value id,
+// instead of a new one to be released.
+type methods struct {
+	mu  sync.Mutex
+	fns map[string]*Func
+}
+
+// get returns the method prop, made by make on the first read.
+func (m *methods) get(prop string, make func(prop string) Func) *Func {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fn, ok := m.fns[prop]; ok {
+		return fn
+	}
+
+	if m.fns == nil {
+		m.fns = map[string]*Func{}
+	}
+	fn := make(prop)
+	m.fns[prop] = &fn
+	return &fn
+}
+
+// builtinError is an error thrown at the guest as an instance of one of the
+// JS error classes, e.g. the RangeError of an invalid typed array length.
+type builtinError struct {
+	class   string
+	message string
+}
+
+func rangeErrorf(format string, args ...interface{}) error {
+	return &builtinError{class: "RangeError", message: fmt.Sprintf(format, args...)}
+}
+
+func typeErrorf(format string, args ...interface{}) error {
+	return &builtinError{class: "TypeError", message: fmt.Sprintf(format, args...)}
+}
+
+func (e *builtinError) Error() string {
+	return e.class + ": " + e.message
+}
+
+func (e *builtinError) object() *object {
+	return propObject(e.class, map[string]interface{}{
+		"name":    e.class,
+		"message": e.message,
+	})
+}
@@ -0,0 +1,105 @@
+package wasm_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestTypedArrays(t *testing.T) {
+	b := startGuest(t, nil)
+	res, err := b.CallFunc("sum", []interface{}{wasm.FromFloat64s([]float64{1.5, 2.5, -1})})
+	if err != nil || res != float64(3) {
+		t.Errorf("sum(Float64Array) = %v, %v, want 3", res, err)
+	}
+
+	res, err = b.CallFunc("halves", []interface{}{4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs, err := wasm.Float64s(res); err != nil || !reflect.DeepEqual(fs, []float64{0, 0.5, 1, 1.5}) {
+		t.Errorf("halves(4) = %v, %v", fs, err)
+	}
+
+	// the guest's Int32Array sees the bytes it copied to a Uint8Array of
+	// the same buffer
+	res, err = b.CallFunc("shared", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"int": float64(258), "byteLength": float64(8), "isInt32": true}
+	for prop, v := range want {
+		if got, err := wasm.Property(res, prop); err != nil || got != v {
+			t.Errorf("shared().%s = %v, %v, want %v", prop, got, err, v)
+		}
+	}
+}
+
+func TestTypedArrayErrors(t *testing.T) {
+	b := startGuest(t, nil)
+	buf, err := wasm.Property(wasm.FromBytes(make([]byte, 8)), "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		args   []interface{}
+		thrown string
+	}{
+		{[]interface{}{"Int32Array", -1}, "RangeError"},
+		{[]interface{}{"Int32Array", buf, 2}, "RangeError"},
+		{[]interface{}{"Int32Array", buf, 0, 3}, "RangeError"},
+		{[]interface{}{"Int32Array", "x"}, "TypeError"},
+		{[]interface{}{"ArrayBuffer", -8}, "RangeError"},
+		{[]interface{}{"DataView", buf, 4, 5}, "RangeError"},
+		{[]interface{}{"DataView", 8}, "TypeError"},
+	} {
+		res, err := b.CallFunc("construct", tt.args)
+		if err != nil {
+			t.Fatalf("construct%v: %v", tt.args, err)
+		}
+		if got, err := wasm.Property(res, "thrown"); err != nil || got != tt.thrown {
+			t.Errorf("construct%v threw %v, %v, want a %s", tt.args, got, err, tt.thrown)
+		}
+	}
+
+	// the guest caught the errors and carries on
+	res, err := b.CallFunc("construct", []interface{}{"Int32Array", 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, err := wasm.Property(res, "instanceOf"); err != nil || is != true {
+		t.Errorf("new Int32Array(2) instanceof Int32Array = %v, %v", is, err)
+	}
+}
+
+func TestTypedArrayMethods(t *testing.T) {
+	b := startGuest(t, nil)
+	buf, err := wasm.Property(wasm.FromBytes(make([]byte, 8)), "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := b.CallFunc("construct", []interface{}{"DataView", buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	view, err := wasm.Property(res, "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same function each time, not a new value id to be released
+	for _, tt := range []struct {
+		v      interface{}
+		method string
+	}{
+		{wasm.FromBytes(make([]byte, 4)), "subarray"},
+		{wasm.FromFloat64s([]float64{1}), "fill"},
+		{view, "getInt8"},
+	} {
+		if same, err := b.CallFunc("sameProp", []interface{}{tt.v, tt.method}); err != nil || same != true {
+			t.Errorf("%T.%s read twice is the same function: %v, %v", tt.v, tt.method, same, err)
+		}
+	}
+}
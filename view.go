@@ -0,0 +1,78 @@
+package wasm
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrViewExpired is returned by a checked View used after the guest was resumed.
+	ErrViewExpired = errors.New("view of guest memory used after the guest was resumed")
+
+	// ErrBufferReleased is the error of using a checked lent buffer after its release.
+	ErrBufferReleased = errors.New("lent buffer used after its release")
+)
+
+// View is a borrowed, zero copy window into the guest's linear memory.
+//
+// A View is only valid until the guest runs again, i.e. until the next
+// CallFunc or until the host Func that borrowed it returns. Bytes waits for
+// the guest to be idle when called from outside of a host Func. The guest is free
+// to grow its memory or move the borrowed bytes after that, so holding on to
+// the slice returned by Bytes is a bug. Copy the bytes out if they are needed
+// for longer. Bridges created WithCheckedViews enforce this.
+type View struct {
+	b   *Bridge
+	ptr int
+	len int
+	gen uint64
+}
+
+// Borrow returns a View of length bytes of guest memory starting at ptr.
+// Guests pass ptr as the address of the first element of a slice,
+// e.g. int(uintptr(unsafe.Pointer(&buf[0]))).
+func (b *Bridge) Borrow(ptr, length int) (*View, error) {
+	leave, err := b.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	if ptr < 0 || length < 0 || ptr+length > len(b.mem()) {
+		return nil, fmt.Errorf("borrow [%d:%d] is outside of guest memory", ptr, ptr+length)
+	}
+
+	return &View{b: b, ptr: ptr, len: length, gen: b.gen}, nil
+}
+
+// Bytes returns the borrowed guest bytes. Writes to the slice are visible to the guest.
+func (v *View) Bytes() ([]byte, error) {
+	leave, err := v.b.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	if v.b.checked && v.gen != v.b.gen {
+		return nil, ErrViewExpired
+	}
+
+	return v.b.mem()[v.ptr : v.ptr+v.len], nil
+}
+
+// Len returns the length of the view.
+func (v *View) Len() int {
+	return v.len
+}
+
+// Lend returns a Uint8Array backed directly by buf. The guest's CopyBytesToJS
+// and CopyBytesToGo on it read and write buf with no intermediate copy.
+//
+// buf is owned by the guest until release is called. After that the array is
+// detached, as if transferred in JS: it is empty and any further copies by the
+// guest fail. On bridges created WithCheckedViews using it at all is an error,
+// which aborts the guest when it indexes or copies it.
+func (b *Bridge) Lend(buf []byte) (v interface{}, release func()) {
+	buffer := &arrayBuffer{data: buf, checked: b.checked}
+	return newArray(kindUint8, buffer, 0, len(buf)), buffer.detach
+}
@@ -0,0 +1,121 @@
+package wasm_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vedhavyas/go-wasm"
+)
+
+func TestLend(t *testing.T) {
+	forEngines(t, func(t *testing.T, e wasm.Engine) {
+		b := startFunction(t, e)
+		buf := []byte("lent to the guest")
+		v, release := b.Lend(buf)
+		res, err := b.CallFunc("bytes", []interface{}{v})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		echo, err := wasm.Bytes(res)
+		if err != nil || !bytes.Equal(echo, buf) {
+			t.Fatalf("bytes(lent) = %q, %v, want %q", echo, err, buf)
+		}
+
+		release()
+		if _, err := wasm.Bytes(v); err == nil {
+			t.Error("Bytes of a released buffer succeeded")
+		}
+
+		// copying from it fails, which the guest's runtime doesn't survive
+		_, err = b.CallFunc("bytes", []interface{}{v})
+		var trap *wasm.GuestTrap
+		if !errors.As(err, &trap) || !strings.Contains(trap.Reason, "CopyBytesToGo") {
+			t.Errorf("guest copying a released buffer: got %v, want its CopyBytesToGo panic", err)
+		}
+	})
+}
+
+func TestLendChecked(t *testing.T) {
+	forEngines(t, func(t *testing.T, e wasm.Engine) {
+		b := startFunction(t, e, wasm.WithCheckedViews())
+		v, release := b.Lend([]byte("lent to the guest"))
+		if _, err := b.CallFunc("bytes", []interface{}{v}); err != nil {
+			t.Fatal(err)
+		}
+
+		release()
+		if _, err := wasm.Bytes(v); !errors.Is(err, wasm.ErrBufferReleased) {
+			t.Errorf("Bytes of a released buffer: got %v, want %v", err, wasm.ErrBufferReleased)
+		}
+
+		_, err := b.CallFunc("bytes", []interface{}{v})
+		var trap *wasm.GuestTrap
+		if !errors.Is(err, wasm.ErrBufferReleased) || !errors.As(err, &trap) {
+			t.Errorf("guest copying a released buffer: got %v, want a trap for %v", err, wasm.ErrBufferReleased)
+		}
+	})
+}
+
+func TestBorrow(t *testing.T) {
+	for _, checked := range []bool{false, true} {
+		var opts []wasm.Option
+		if checked {
+			opts = append(opts, wasm.WithCheckedViews())
+		}
+
+		var v *wasm.View
+		var filledErr error
+		b := startGuest(t, func(b *wasm.Bridge) {
+			b.SetFunc("host.fill", func(args []interface{}) (interface{}, error) {
+				ptr, l := int(args[0].(float64)), int(args[1].(float64))
+				if _, err := b.Borrow(ptr, l+b.MemorySize()); err == nil {
+					t.Error("Borrow past the end of guest memory succeeded")
+				}
+
+				var err error
+				if v, err = b.Borrow(ptr, l); err != nil {
+					return nil, err
+				}
+				p, err := v.Bytes()
+				if err != nil {
+					return nil, err
+				}
+				copy(p, "borrowed")
+				return nil, nil
+			})
+
+			// a host function called after the one that borrowed
+			b.SetFunc("host.filled", func(args []interface{}) (interface{}, error) {
+				_, filledErr = v.Bytes()
+				return nil, nil
+			})
+		}, opts...)
+
+		res, err := b.CallFunc("borrow", []interface{}{8})
+		if err != nil || res != "borrowed" {
+			t.Fatalf("borrow(8) = %v, %v, want borrowed", res, err)
+		}
+		if v.Len() != 8 {
+			t.Errorf("view of %d bytes, want 8", v.Len())
+		}
+
+		_, err = v.Bytes()
+		if !checked {
+			if filledErr != nil || err != nil {
+				t.Errorf("unchecked view used later: %v, then %v", filledErr, err)
+			}
+			continue
+		}
+
+		// the view expired as the host function that borrowed it returned
+		if !errors.Is(filledErr, wasm.ErrViewExpired) {
+			t.Errorf("view used by the next host function: got %v, want %v", filledErr, wasm.ErrViewExpired)
+		}
+		if !errors.Is(err, wasm.ErrViewExpired) {
+			t.Errorf("view used after the call: got %v, want %v", err, wasm.ErrViewExpired)
+		}
+	}
+}